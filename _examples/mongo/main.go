@@ -25,7 +25,7 @@ func main() {
 	// Reset the db
 	cols, _ := DB.Collections()
 	for _, k := range cols {
-		col, err := DB.Collection(k)
+		col, err := DB.GetCollection(k)
 		if err == nil {
 			col.Truncate()
 		}
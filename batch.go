@@ -0,0 +1,316 @@
+package bondb
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"upper.io/db"
+)
+
+// BatchError is returned by CreateMany, SaveMany and DeleteMany when some of
+// the items failed. The other items were written.
+type BatchError struct {
+	Errors map[int]error // by the index of the item in the slice
+}
+
+func (e *BatchError) Error() string {
+	indexes := e.Indexes()
+	return fmt.Sprintf("bondb: %d of the items failed, item %d: %v", len(indexes), indexes[0], e.Errors[indexes[0]])
+}
+
+// Indexes returns the indexes of the failed items in order.
+func (e *BatchError) Indexes() []int {
+	indexes := make([]int, 0, len(e.Errors))
+	for i := range e.Errors {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
+func batchError(errs map[int]error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return &BatchError{Errors: errs}
+}
+
+// CreateMany inserts the items of a slice of structs or struct pointers.
+// Each item is prepared as by Create and inserted in batches sized for the
+// adapter, on mongo and postgresql, or one by one otherwise. The primary
+// keys of the new records are set on the items.
+//
+// Items that fail, from BeforeSave to their insert, are reported in a
+// *BatchError while the others are inserted.
+func (s *Session) CreateMany(items interface{}) error {
+	return s.saveMany(items, true)
+}
+
+// SaveMany saves the items of a slice of structs or struct pointers. New
+// items are inserted in batches as by CreateMany, and existing ones are
+// updated one by one as by Save.
+func (s *Session) SaveMany(items interface{}) error {
+	return s.saveMany(items, false)
+}
+
+func (s *Session) saveMany(items interface{}, create bool) error {
+	if err := s.ctxErr(); err != nil {
+		return err
+	}
+	elems, err := sliceItems(items)
+	if err != nil || len(elems) == 0 {
+		return err
+	}
+	col, err := s.GetCollection(elems[0].Interface())
+	if err != nil {
+		return err
+	}
+	sinfo, err := getStructInfo(structType(elems[0].Type()))
+	if err != nil {
+		return err
+	}
+
+	errs := make(map[int]error)
+	var inserts []int
+	for i, itemv := range elems {
+		if !indirectStruct(itemv).IsValid() {
+			errs[i] = db.ErrExpectingPointer
+			continue
+		}
+		if !create {
+			pk, err := s.getPrimaryKey(itemv)
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			if pk != nil {
+				if err := s.Save(itemv.Interface()); err != nil {
+					errs[i] = err
+				}
+				continue
+			}
+		}
+		if err := s.beforeInsert(col, itemv); err != nil {
+			errs[i] = err
+			continue
+		}
+		inserts = append(inserts, i)
+	}
+
+	s.insertMany(col, sinfo, elems, inserts, errs)
+	for _, i := range inserts {
+		if _, failed := errs[i]; failed {
+			continue
+		}
+		if !create {
+			snapshot(indirectStruct(elems[i]))
+		}
+		s.afterSave(elems[i].Interface())
+	}
+	return batchError(errs)
+}
+
+// insertMany inserts the items of elems at the given indexes in batches,
+// setting their primary keys, and records the items that fail in errs.
+func (s *Session) insertMany(col db.Collection, sinfo *structInfo, elems []reflect.Value, indexes []int, errs map[int]error) {
+	drv, err := s.driver()
+	size := 1
+	if err == nil {
+		size = drv.batchSize(len(sinfo.FieldsList))
+	}
+	for start := 0; start < len(indexes); start += size {
+		batch := indexes[start:]
+		if len(batch) > size {
+			batch = batch[:size]
+		}
+		if err := s.ctxErr(); err != nil {
+			for _, i := range indexes[start:] {
+				errs[i] = err
+			}
+			return
+		}
+
+		if drv != nil {
+			values := make([]reflect.Value, len(batch))
+			for j, i := range batch {
+				values[j] = indirectStruct(elems[i])
+			}
+			ids, failed, err := drv.insertMany(col.Name(), sinfo, values)
+			if err == nil {
+				for j, i := range batch {
+					if err, ok := failed[j]; ok {
+						errs[i] = err
+					} else if ids[j] != nil {
+						if err := s.setPrimaryKey(elems[i], ids[j]); err != nil {
+							errs[i] = err
+						}
+					}
+				}
+				continue
+			}
+			if err != db.ErrUnsupported {
+				for _, i := range batch {
+					errs[i] = err
+				}
+				continue
+			}
+			drv = nil // insert one by one from now on
+		}
+
+		for _, i := range batch {
+			oid, err := col.Append(elems[i].Interface())
+			if err == nil {
+				err = s.setPrimaryKey(elems[i], oid)
+			}
+			if err != nil {
+				errs[i] = err
+			}
+		}
+	}
+}
+
+// DeleteMany deletes the items of a slice of structs or struct pointers, as
+// by Delete. BeforeDelete runs for each item, and the records are then
+// removed, or soft deleted, in batches by their primary key.
+//
+// Items that fail are reported in a *BatchError while the others are
+// deleted.
+func (s *Session) DeleteMany(items interface{}) error {
+	if err := s.ctxErr(); err != nil {
+		return err
+	}
+	elems, err := sliceItems(items)
+	if err != nil || len(elems) == 0 {
+		return err
+	}
+	col, err := s.GetCollection(elems[0].Interface())
+	if err != nil {
+		return err
+	}
+	sinfo, err := getStructInfo(structType(elems[0].Type()))
+	if err != nil {
+		return err
+	}
+	fi := sinfo.DeletedFieldInfo
+	kind := HardDelete
+	if fi != nil {
+		kind = SoftDelete
+	}
+
+	errs := make(map[int]error)
+	var deletes []int
+	pks := make([]db.Cond, len(elems))
+	for i, itemv := range elems {
+		if !indirectStruct(itemv).IsValid() {
+			errs[i] = db.ErrExpectingPointer
+			continue
+		}
+		if err := beforeDelete(s.Context(), itemv.Interface(), kind); err != nil {
+			errs[i] = err
+			continue
+		}
+		pk, err := s.getPrimaryKey(itemv)
+		if err == nil && pk == nil {
+			err = ErrNoPrimaryKey
+		}
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		pks[i] = pk
+		deletes = append(deletes, i)
+	}
+
+	now := s.Now()
+	if fi != nil && fi.UTC {
+		now = now.UTC()
+	}
+	drv, drvErr := s.driver()
+	remove := func(cond db.Cond) error {
+		if drvErr == nil {
+			var err error
+			if kind == SoftDelete {
+				_, err = drv.update(col.Name(), cond, map[string]interface{}{fi.Key: now})
+			} else {
+				_, err = drv.remove(col.Name(), cond)
+			}
+			return err
+		}
+		if kind == SoftDelete {
+			return col.Find(cond).Update(map[string]interface{}{fi.Key: now})
+		}
+		return col.Find(cond).Remove()
+	}
+
+	size := 1
+	if sinfo.PKFieldInfo != nil {
+		size = 1000
+		if drvErr == nil {
+			size = drv.batchSize(1)
+		}
+	}
+	for start := 0; start < len(deletes); start += size {
+		batch := deletes[start:]
+		if len(batch) > size {
+			batch = batch[:size]
+		}
+		err := s.ctxErr()
+		if err == nil {
+			if size == 1 {
+				err = remove(pks[batch[0]])
+			} else {
+				key := sinfo.PKFieldInfo.Key
+				ids := make([]interface{}, len(batch))
+				for j, i := range batch {
+					ids[j] = pks[i][key]
+				}
+				if drvErr == nil {
+					// a list matches any of its elements in a driver condition
+					err = remove(db.Cond{key: ids})
+				} else {
+					err = remove(db.Cond{key + " IN": ids})
+				}
+			}
+		}
+		if err != nil {
+			for _, i := range batch {
+				errs[i] = err
+			}
+		}
+	}
+
+	for _, i := range deletes {
+		if _, failed := errs[i]; failed {
+			continue
+		}
+		if kind == SoftDelete {
+			if v := indirectStruct(elems[i]); v.CanSet() {
+				setTime(v.FieldByIndex(fi.Index), now, fi.UTC)
+			}
+		}
+		s.afterDelete(elems[i].Interface(), kind)
+	}
+	return batchError(errs)
+}
+
+// sliceItems returns pointers to the items of a slice, or pointer to a
+// slice, of structs or struct pointers.
+func sliceItems(items interface{}) ([]reflect.Value, error) {
+	v := reflect.ValueOf(items)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Slice || structType(v.Type()) == nil {
+		return nil, db.ErrExpectingSlicePointer
+	}
+	elems := make([]reflect.Value, v.Len())
+	for i := range elems {
+		e := v.Index(i)
+		if e.Kind() != reflect.Ptr {
+			e = e.Addr()
+		}
+		elems[i] = e
+	}
+	return elems, nil
+}
@@ -1,17 +1,48 @@
 package bondb
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"reflect"
 	"strings"
 	"sync"
+	"time"
 )
 
 var (
 	ErrUnknownCollectionName = errors.New("unknown collection name")
+
+	// ErrNoPrimaryKey is returned when an operation needs the primary key
+	// of an item, but its type has no pk field or the key is unset.
+	ErrNoPrimaryKey = errors.New("no primary key")
+
+	// ErrUnsettablePK is returned when the primary key assigned by the
+	// database can't be set on the item's pk field.
+	ErrUnsettablePK = errors.New("primary key field can't be set")
+
+	// ErrStaleObject is returned when saving an item with a version field
+	// that was changed in the database since the item was loaded.
+	ErrStaleObject = errors.New("stale object")
+
+	// ErrMultipleRows is returned by a Strict query's One when more than
+	// one record matches.
+	ErrMultipleRows = errors.New("more than one record matches")
 )
 
+// ErrInvalidTag is returned for a struct type with an unknown flag in a
+// bondb tag, or a flag that doesn't suit the type of its field.
+type ErrInvalidTag struct {
+	Type   reflect.Type
+	Field  string // Go field name
+	Flag   string
+	Reason string
+}
+
+func (e ErrInvalidTag) Error() string {
+	return fmt.Sprintf("invalid flag %q in bondb tag of %s.%s: %s", e.Flag, e.Type, e.Field, e.Reason)
+}
+
 type CanCollectionName interface {
 	CollectionName() string
 }
@@ -36,18 +67,159 @@ type CanAfterFind interface {
 	AfterFind()
 }
 
+// DeleteKind tells delete hooks which kind of delete is happening.
+type DeleteKind int
+
+const (
+	HardDelete DeleteKind = iota // the record is removed from the database
+	SoftDelete                   // the record's softdelete field is set
+)
+
+// CanBeforeDeleteKind and CanAfterDeleteKind are called along with
+// BeforeDelete and AfterDelete for items that need to know the kind of delete.
+type CanBeforeDeleteKind interface {
+	BeforeDeleteKind(kind DeleteKind) error
+}
+
+type CanAfterDeleteKind interface {
+	AfterDeleteKind(kind DeleteKind)
+}
+
+// The Context variants of the hooks receive the context of the session, see
+// Session.WithContext. They are called after their plain counterparts.
+type CanBeforeSaveContext interface {
+	BeforeSaveContext(ctx context.Context) error
+}
+
+type CanAfterSaveContext interface {
+	AfterSaveContext(ctx context.Context)
+}
+
+type CanBeforeDeleteContext interface {
+	BeforeDeleteContext(ctx context.Context) error
+}
+
+type CanAfterDeleteContext interface {
+	AfterDeleteContext(ctx context.Context)
+}
+
+type CanAfterFindContext interface {
+	AfterFindContext(ctx context.Context)
+}
+
+func beforeSave(ctx context.Context, item interface{}) error {
+	if i, ok := item.(CanBeforeSave); ok {
+		err := i.BeforeSave()
+		if err != nil {
+			return err
+		}
+	}
+	if i, ok := item.(CanBeforeSaveContext); ok {
+		err := i.BeforeSaveContext(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func afterSave(ctx context.Context, item interface{}) {
+	if i, ok := item.(CanAfterSave); ok {
+		i.AfterSave()
+	}
+	if i, ok := item.(CanAfterSaveContext); ok {
+		i.AfterSaveContext(ctx)
+	}
+}
+
+func beforeDelete(ctx context.Context, item interface{}, kind DeleteKind) error {
+	if i, ok := item.(CanBeforeDelete); ok {
+		err := i.BeforeDelete()
+		if err != nil {
+			return err
+		}
+	}
+	if i, ok := item.(CanBeforeDeleteKind); ok {
+		err := i.BeforeDeleteKind(kind)
+		if err != nil {
+			return err
+		}
+	}
+	if i, ok := item.(CanBeforeDeleteContext); ok {
+		err := i.BeforeDeleteContext(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func afterDelete(ctx context.Context, item interface{}, kind DeleteKind) {
+	if i, ok := item.(CanAfterDelete); ok {
+		i.AfterDelete()
+	}
+	if i, ok := item.(CanAfterDeleteKind); ok {
+		i.AfterDeleteKind(kind)
+	}
+	if i, ok := item.(CanAfterDeleteContext); ok {
+		i.AfterDeleteContext(ctx)
+	}
+}
+
 // NOTE: struct tag code borrowed + inspired from https://labix.org/mgo library
 var structMap = make(map[reflect.Type]*structInfo)
 var structMapMutex sync.RWMutex
 
 type structInfo struct {
-	FieldsList  []fieldInfo
-	Zero        reflect.Value
-	PKFieldInfo *fieldInfo
+	FieldsList       []fieldInfo
+	Zero             reflect.Value
+	PKFieldInfo      *fieldInfo   // nil for composite primary keys
+	PKFieldsList     []*fieldInfo // all fields of the primary key, in order
+	CreatedFieldInfo *fieldInfo
+	UpdatedFieldInfo *fieldInfo
+	VersionFieldInfo *fieldInfo
+	DeletedFieldInfo *fieldInfo
+	FieldsByKey      map[string]*fieldInfo
+	FieldsByName     map[string]*fieldInfo
+}
+
+// field returns the field with the given db key or Go name, or nil if
+// there is none.
+func (si *structInfo) field(name string) *fieldInfo {
+	if fi, ok := si.FieldsByKey[name]; ok {
+		return fi
+	}
+	return si.FieldsByName[name]
+}
+
+// key returns the db key for name, which is either a db key or a Go field
+// name. Dotted paths into sub-documents, ie. "Social.network", have their
+// first element translated.
+func (si *structInfo) key(name string) (string, error) {
+	path := ""
+	if i := strings.Index(name, "."); i > 0 {
+		name, path = name[:i], name[i:]
+	}
+	fi := si.field(name)
+	if fi == nil {
+		return "", &UnknownFieldError{Type: si.Zero.Type(), Name: name}
+	}
+	return fi.Key + path, nil
+}
+
+// UnknownFieldError is returned by queries that refer to a field that is
+// neither a db key nor a Go field name of the struct.
+type UnknownFieldError struct {
+	Type reflect.Type
+	Name string
+}
+
+func (e *UnknownFieldError) Error() string {
+	return fmt.Sprintf("unknown field %q for %s", e.Name, e.Type)
 }
 
 type fieldInfo struct {
-	Index    int
+	Index    []int // index path, see reflect.Value.FieldByIndex
 	Name     string
 	Tag      reflect.StructTag
 	Zero     reflect.Value
@@ -55,6 +227,12 @@ type fieldInfo struct {
 	PK       bool   // primary key flag
 	Required bool   // required field flag
 	UTC      bool   // convert time to utc
+	Created  bool   // set to the current time on insert
+	Updated  bool   // set to the current time on insert and update
+	Version  bool   // optimistic locking version
+	Deleted  bool   // soft delete time
+	Gen      string // primary key generator, ie. uuid
+	Rules    []rule // validation rules, ie. min=1
 }
 
 func getStructInfo(st reflect.Type) (*structInfo, error) {
@@ -65,69 +243,272 @@ func getStructInfo(st reflect.Type) (*structInfo, error) {
 		return sinfo, nil
 	}
 
+	fieldsList, err := structFields(st, nil)
+	if err != nil {
+		return nil, err
+	}
+	fieldsList = dominantFields(fieldsList)
+
+	sinfo = &structInfo{
+		FieldsList:   fieldsList,
+		Zero:         reflect.New(st).Elem(),
+		FieldsByKey:  make(map[string]*fieldInfo, len(fieldsList)),
+		FieldsByName: make(map[string]*fieldInfo, len(fieldsList)),
+	}
+	for i := range fieldsList {
+		info := &fieldsList[i]
+		sinfo.FieldsByKey[info.Key] = info
+		sinfo.FieldsByName[info.Name] = info
+		if info.PK {
+			sinfo.PKFieldsList = append(sinfo.PKFieldsList, info)
+		}
+		if info.Created {
+			sinfo.CreatedFieldInfo = info
+		}
+		if info.Updated {
+			sinfo.UpdatedFieldInfo = info
+		}
+		if info.Version {
+			sinfo.VersionFieldInfo = info
+		}
+		if info.Deleted {
+			sinfo.DeletedFieldInfo = info
+		}
+	}
+	if len(sinfo.PKFieldsList) == 1 {
+		sinfo.PKFieldInfo = sinfo.PKFieldsList[0]
+	}
+	structMapMutex.Lock()
+	structMap[st] = sinfo
+	structMapMutex.Unlock()
+	return sinfo, nil
+}
+
+// structFields returns the fields of st, flattening inline and anonymous
+// embedded structs. index is the index path of st in the outer struct.
+func structFields(st reflect.Type, index []int) ([]fieldInfo, error) {
 	n := st.NumField()
 	fieldsList := make([]fieldInfo, 0, n)
-	var pkFieldInfo *fieldInfo
 
 	for i := 0; i != n; i++ {
 		field := st.Field(i)
-		if field.PkgPath != "" {
+		if field.PkgPath != "" && !field.Anonymous {
 			continue // Private field
 		}
 
 		info := fieldInfo{
-			Index: i,
+			Index: append(index[:len(index):len(index)], i),
 			Name:  field.Name,
 			Tag:   field.Tag,
 			Zero:  reflect.New(field.Type).Elem(),
 		}
 
-		info.Key = info.Tag.Get("db")
-		if info.Key == "" {
-			info.Key = info.Tag.Get("field")
+		tag := info.Tag.Get("db")
+		if tag == "" {
+			tag = info.Tag.Get("field")
 		}
-		if info.Key == "" {
-			info.Key = info.Tag.Get("bson")
+		if tag == "" {
+			tag = info.Tag.Get("bson")
 		}
-		if info.Key != "" {
-			parts := strings.Split(info.Key, ",")
-			info.Key = parts[0]
+		parts := strings.Split(tag, ",")
+		info.Key = parts[0]
+
+		inline := containsString(parts[1:], "inline") || (field.Anonymous && info.Key == "")
+		if inline && field.Type.Kind() == reflect.Struct && field.Type != timeType {
+			inlined, err := structFields(field.Type, info.Index)
+			if err != nil {
+				return nil, err
+			}
+			fieldsList = append(fieldsList, inlined...)
+			continue
 		}
-		if info.Key == "" || info.Key == "-" {
+		if field.PkgPath != "" || info.Key == "" || info.Key == "-" {
 			continue
 		}
 
-		attrs := strings.Split(field.Tag.Get("bondb"), ",")
+		attrs := splitTag(field.Tag.Get("bondb"))
 		if len(attrs) > 1 {
 			for _, flag := range attrs[1:] {
+				invalid := func(reason string) error {
+					return ErrInvalidTag{Type: st, Field: field.Name, Flag: flag, Reason: reason}
+				}
 				switch flag {
 				case "pk":
 					info.PK = true
-					pkFieldInfo = &info
 				case "required":
 					info.Required = true
 				case "utc":
-					if field.Type.Name() != "Time" && field.Type.Elem().Name() != "Time" {
-						panic(fmt.Sprintf("Unsupported type for utc: %s", field.Type.Name()))
+					if !isTimeType(field.Type) {
+						return nil, invalid(fmt.Sprintf("unsupported type %s", field.Type))
 					}
 					info.UTC = true
+				case "created":
+					if !isTimeType(field.Type) {
+						return nil, invalid(fmt.Sprintf("unsupported type %s", field.Type))
+					}
+					info.Created = true
+				case "updated":
+					if !isTimeType(field.Type) {
+						return nil, invalid(fmt.Sprintf("unsupported type %s", field.Type))
+					}
+					info.Updated = true
+				case "version":
+					switch field.Type.Kind() {
+					case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+						reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+					default:
+						return nil, invalid(fmt.Sprintf("unsupported type %s", field.Type))
+					}
+					info.Version = true
+				case "softdelete":
+					if !isTimeType(field.Type) {
+						return nil, invalid(fmt.Sprintf("unsupported type %s", field.Type))
+					}
+					info.Deleted = true
 
 				default:
-					panic(fmt.Sprintf("Unsupported flag %q in tag %q of type %s", flag, info.Key, st))
+					if strings.HasPrefix(flag, "gen=") {
+						info.Gen = flag[len("gen="):]
+						if info.Gen == "" {
+							return nil, invalid("missing generator name")
+						}
+						continue
+					}
+					name, arg := flag, ""
+					if i := strings.Index(flag, "="); i >= 0 {
+						name, arg = flag[:i], flag[i+1:]
+					}
+					r, err := newRule(name, arg, field.Type)
+					if err == errUnknownRule {
+						return nil, invalid("unknown flag")
+					}
+					if err != nil {
+						return nil, invalid(err.Error())
+					}
+					info.Rules = append(info.Rules, r)
 				}
 			}
 		}
 
+		if info.Gen != "" && !info.PK {
+			return nil, ErrInvalidTag{Type: st, Field: field.Name, Flag: "gen=" + info.Gen, Reason: "gen requires pk"}
+		}
+
 		fieldsList = append(fieldsList, info)
 	}
+	return fieldsList, nil
+}
 
-	sinfo = &structInfo{
-		FieldsList:  fieldsList,
-		Zero:        reflect.New(st).Elem(),
-		PKFieldInfo: pkFieldInfo,
+// dominantFields drops fields shadowed by a field with the same db key at a
+// shallower depth, the way Go hides promoted fields of embedded structs.
+func dominantFields(fieldsList []fieldInfo) []fieldInfo {
+	depth := make(map[string]int, len(fieldsList))
+	for _, info := range fieldsList {
+		if d, ok := depth[info.Key]; !ok || len(info.Index) < d {
+			depth[info.Key] = len(info.Index)
+		}
 	}
-	structMapMutex.Lock()
-	structMap[st] = sinfo
-	structMapMutex.Unlock()
-	return sinfo, nil
+	dominant := fieldsList[:0]
+	for _, info := range fieldsList {
+		if len(info.Index) == depth[info.Key] {
+			dominant = append(dominant, info)
+			depth[info.Key] = -1 // keep the first of equally deep fields
+		}
+	}
+	return dominant
+}
+
+// splitTag splits a bondb tag on commas. A comma can be escaped with a
+// backslash, ie. for regular expressions given to the match rule. As struct
+// tag values are unquoted, the backslash is itself escaped in the tag, ie.
+// `bondb:"match=^[a-z]{2\\,3}$"`.
+func splitTag(tag string) []string {
+	var parts []string
+	var part []byte
+	for i := 0; i < len(tag); i++ {
+		switch {
+		case tag[i] == '\\' && i+1 < len(tag) && tag[i+1] == ',':
+			part = append(part, ',')
+			i++
+		case tag[i] == ',':
+			parts = append(parts, string(part))
+			part = part[:0]
+		default:
+			part = append(part, tag[i])
+		}
+	}
+	return append(parts, string(part))
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// isTimeType reports whether t is a time.Time or a pointer to one.
+func isTimeType(t reflect.Type) bool {
+	return t == timeType || (t.Kind() == reflect.Ptr && t.Elem() == timeType)
+}
+
+// isZero reports whether v holds the zero value of its type. Nil pointers,
+// empty strings, slices and maps, and zero times are all considered zero.
+func isZero(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String:
+		return len(v.String()) == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if !isZero(v.Index(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Struct:
+		if v.Type() == timeType && v.CanInterface() {
+			return v.Interface().(time.Time).IsZero()
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if !isZero(v.Field(i)) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// structType returns the struct type behind pointers and slices of t, or nil
+// if there is none.
+func structType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	return t
+}
+
+// indirectStruct dereferences v until it reaches a struct. It returns an
+// invalid reflect.Value if v doesn't point to a struct.
+func indirectStruct(v reflect.Value) reflect.Value {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return reflect.Value{}
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return reflect.Value{}
+	}
+	return v
 }
@@ -1,6 +1,11 @@
 package bondb_test
 
 import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"testing"
@@ -9,6 +14,7 @@ import (
 	"github.com/pressly/bondb"
 	"upper.io/db"
 	_ "upper.io/db/mongo"
+	_ "upper.io/db/postgresql"
 
 	"github.com/stretchr/testify/assert"
 	"gopkg.in/mgo.v2/bson"
@@ -77,20 +83,331 @@ func (a User) CollectionName() string {
 	return `users`
 }
 
+type Post struct {
+	Id    bson.ObjectId `bson:"_id,omitempty" bondb:",pk"`
+	Title string        `bson:"title" bondb:",required"`
+	Body  string        `bson:"body" bondb:",required"`
+	Draft bool          `bson:"draft"`
+	Rev   int           `bson:"rev" bondb:",version"`
+
+	CreatedAt time.Time  `bson:"created_at" bondb:",created,utc"`
+	UpdatedAt *time.Time `bson:"updated_at" bondb:",updated"`
+}
+
+func (p *Post) CollectionName() string {
+	return `posts`
+}
+
+func (p *Post) BeforeSave() error {
+	if p.Title == "" && p.Draft {
+		p.Title = "Untitled"
+	}
+	return nil
+}
+
+type Profile struct {
+	Id       bson.ObjectId `bson:"_id,omitempty" bondb:",pk"`
+	Username string        `bson:"username" bondb:",required,min=3,max=16,match=^[a-z0-9_]+$"`
+	Email    string        `bson:"email" bondb:",email"`
+	Status   string        `bson:"status" bondb:",oneof=active|disabled"`
+	Age      int           `bson:"age" bondb:",min=13,max=150"`
+	Tags     []string      `bson:"tags" bondb:",max=3"`
+	Country  *string       `bson:"country" bondb:",len=2"`
+	Code     string        `bson:"code" bondb:",len=3,match=^[a-zé]{2\\,3}$"`
+}
+
+func (p *Profile) CollectionName() string {
+	return `profiles`
+}
+
+type Comment struct {
+	Id        bson.ObjectId `bson:"_id,omitempty" bondb:",pk"`
+	Body      string        `bson:"body"`
+	DeletedAt *time.Time    `bson:"deleted_at" bondb:",softdelete"`
+
+	deleteKinds []bondb.DeleteKind
+}
+
+func (c *Comment) CollectionName() string {
+	return `comments`
+}
+
+func (c *Comment) AfterDeleteKind(kind bondb.DeleteKind) {
+	c.deleteKinds = append(c.deleteKinds, kind)
+}
+
+type Page struct {
+	bondb.Tracked `bson:"-"`
+
+	Id    bson.ObjectId `bson:"_id,omitempty" bondb:",pk"`
+	Title string        `bson:"title"`
+	Views int           `bson:"views"`
+	Tags  []string      `bson:"tags"`
+}
+
+func (p *Page) CollectionName() string {
+	return `pages`
+}
+
+type badTag struct {
+	Id   bson.ObjectId `bson:"_id,omitempty" bondb:",pk"`
+	Name string        `bson:"name" bondb:",utc"`
+}
+
+func (b *badTag) CollectionName() string {
+	return `bad_tags`
+}
+
+type Setting struct {
+	Id    string `bson:"_id,omitempty" bondb:",pk"`
+	Value string `bson:"value"`
+}
+
+func (s *Setting) CollectionName() string {
+	return `settings`
+}
+
+func (s *Setting) SetID(ids map[string]interface{}) error {
+	s.Id = ids["_id"].(bson.ObjectId).Hex()
+	return nil
+}
+
+type ctxKey string
+
+type Note struct {
+	Id     bson.ObjectId `bson:"_id,omitempty" bondb:",pk"`
+	Text   string        `bson:"text"`
+	Author string        `bson:"author"`
+
+	foundBy string
+}
+
+func (n *Note) CollectionName() string {
+	return `notes`
+}
+
+func (n *Note) BeforeSaveContext(ctx context.Context) error {
+	if actor, ok := ctx.Value(ctxKey("actor")).(string); ok {
+		n.Author = actor
+	}
+	return nil
+}
+
+func (n *Note) AfterFindContext(ctx context.Context) {
+	n.foundBy, _ = ctx.Value(ctxKey("actor")).(string)
+}
+
 // TODO: test this for mysql.. how to do inline stuff like this..?
 type accountResource struct {
 	Account    `bson:",inline"`
 	ExtraField string `bson:"extra"`
 }
 
-// NOTE: ugly........
-func (a *accountResource) CollectionName() string {
-	return `accounts`
+type accountView struct {
+	Acc  Account `bson:",inline"`
+	Note string  `bson:"note"`
+}
+
+type Tag struct {
+	Id   bson.ObjectId `bson:"_id,omitempty" bondb:",pk"`
+	Name string        `bson:"name"`
+}
+
+type AuditEntry struct {
+	Id      bson.ObjectId `bson:"_id,omitempty" bondb:",pk"`
+	Message string        `bson:"message"`
+}
+
+type Membership struct {
+	UserId  bson.ObjectId `bson:"user_id" bondb:",pk"`
+	GroupId bson.ObjectId `bson:"group_id" bondb:",pk"`
+	Role    string        `bson:"role"`
+}
+
+func (m *Membership) CollectionName() string {
+	return `memberships`
+}
+
+type Subscriber struct {
+	Id        bson.ObjectId `bson:"_id,omitempty" bondb:",pk"`
+	Email     string        `bson:"email" bondb:",required"`
+	Name      string        `bson:"name"`
+	CreatedAt time.Time     `bson:"created_at" bondb:",created"`
+}
+
+func (s *Subscriber) CollectionName() string {
+	return `subscribers`
+}
+
+type Article struct {
+	Id    bson.ObjectId `bson:"_id,omitempty" bondb:",pk"`
+	Slug  string        `bson:"slug"`
+	Views int           `bson:"views"`
+	Tags  []string      `bson:"tags"`
+	Rev   int           `bson:"rev" bondb:",version"`
+}
+
+func (a *Article) CollectionName() string {
+	return `articles`
+}
+
+type Invoice struct {
+	Id     string `bson:"_id,omitempty" bondb:",pk,gen=ulid"`
+	Number int64  `bson:"number"`
+}
+
+func (i *Invoice) CollectionName() string {
+	return `invoices`
+}
+
+func (i *Invoice) BeforeSave() error {
+	if i.Id == "" {
+		return errors.New("Id not generated before BeforeSave")
+	}
+	return nil
+}
+
+type Ticket struct {
+	Id    int64  `bson:"_id,omitempty" bondb:",pk,gen=seq"`
+	Title string `bson:"title"`
+}
+
+func (t *Ticket) CollectionName() string {
+	return `tickets`
+}
+
+type Order struct {
+	Id    string `bson:"_id,omitempty" bondb:",pk,gen=order"`
+	Total int    `bson:"total"`
+}
+
+func (o *Order) CollectionName() string {
+	return `orders`
+}
+
+type Ledger struct {
+	Id      int64 `db:"id" bondb:",pk"`
+	Balance int   `db:"balance"`
+	Rev     int   `db:"rev" bondb:",version"`
+	saved   int
+}
+
+func (l *Ledger) CollectionName() string {
+	return `ledgers`
+}
+
+func (l *Ledger) AfterSave() {
+	l.saved++
+}
+
+// fakeSQL is a minimal SQL adapter on the fakesql database/sql driver,
+// whose connections record the statements run on them in fakeStmts.
+type fakeSQL struct {
+	pool *sql.DB
+}
+
+var fakeStmts []string
+
+func (d *fakeSQL) Driver() interface{}            { return d.pool }
+func (d *fakeSQL) Open() error                    { return nil }
+func (d *fakeSQL) Clone() (db.Database, error)    { return d, nil }
+func (d *fakeSQL) Ping() error                    { return nil }
+func (d *fakeSQL) Close() error                   { return d.pool.Close() }
+func (d *fakeSQL) Collections() ([]string, error) { return nil, nil }
+func (d *fakeSQL) Use(string) error               { return nil }
+func (d *fakeSQL) Drop() error                    { return nil }
+func (d *fakeSQL) Name() string                   { return "fake" }
+func (d *fakeSQL) Collection(names ...string) (db.Collection, error) {
+	return fakeCollection(names[0]), nil
+}
+
+func (d *fakeSQL) Setup(db.ConnectionURL) (err error) {
+	d.pool, err = sql.Open("fakesql", "")
+	return
+}
+
+func (d *fakeSQL) Transaction() (db.Tx, error) {
+	tx, err := d.pool.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &fakeSQLTx{SQLTx: &SQLTx{tx}, fakeSQL: d}, nil
+}
+
+type fakeCollection string
+
+func (c fakeCollection) Append(interface{}) (interface{}, error) { return nil, db.ErrUnsupported }
+func (c fakeCollection) Exists() bool                            { return true }
+func (c fakeCollection) Find(...interface{}) db.Result           { return nil }
+func (c fakeCollection) Truncate() error                         { return nil }
+func (c fakeCollection) Name() string                            { return string(c) }
+
+// SQLTx stands in for the transaction wrapper embedded by the transaction
+// types of the upper.io/db SQL adapters.
+type SQLTx struct {
+	*sql.Tx
+}
+
+// fakeSQLTx is shaped like the adapters' transaction types, whose own Exec
+// shadows the one of the *sql.Tx.
+type fakeSQLTx struct {
+	*SQLTx
+	*fakeSQL
+}
+
+func (tx *fakeSQLTx) Exec(stmt fmt.Stringer, args ...interface{}) (sql.Result, error) {
+	return tx.SQLTx.Exec(stmt.String(), args...)
+}
+
+// fakeSQLDriver is a database/sql driver accepting any statement.
+type fakeSQLDriver struct{}
+
+func (fakeSQLDriver) Open(string) (driver.Conn, error) { return &fakeSQLConn{}, nil }
+
+type fakeSQLConn struct {
+	inTx bool
+}
+
+func (c *fakeSQLConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeSQLStmt{conn: c, query: query}, nil
+}
+
+func (c *fakeSQLConn) Close() error              { return nil }
+func (c *fakeSQLConn) Begin() (driver.Tx, error) { c.inTx = true; return c, nil }
+func (c *fakeSQLConn) Commit() error             { c.record("COMMIT"); c.inTx = false; return nil }
+func (c *fakeSQLConn) Rollback() error           { c.record("ROLLBACK"); c.inTx = false; return nil }
+
+func (c *fakeSQLConn) record(query string) {
+	prefix := "db: "
+	if c.inTx {
+		prefix = "tx: "
+	}
+	fakeStmts = append(fakeStmts, prefix+query)
+}
+
+type fakeSQLStmt struct {
+	conn  *fakeSQLConn
+	query string
+}
+
+func (s *fakeSQLStmt) Close() error  { return nil }
+func (s *fakeSQLStmt) NumInput() int { return -1 }
+
+func (s *fakeSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.conn.record(s.query)
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakeSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("fakesql: Query is not supported")
 }
 
 //--
 
 func init() {
+	sql.Register("fakesql", fakeSQLDriver{})
+	db.Register("fakesql", &fakeSQL{})
+
 	DB, _ = bondb.NewSession("mongo", db.Settings{
 		Host:     "127.0.0.1",
 		Database: "bondb_test",
@@ -355,6 +672,21 @@ func TestEmbeddedModel(t *testing.T) {
 	err = DB.Query(&ress).All()
 	assert.NoError(err)
 	assert.NotEmpty(ress)
+
+	// The primary key is found in the embedded struct
+	res.Name = "sup resource"
+	err = DB.Save(res)
+	assert.NoError(err)
+
+	var chk *Account
+	err = DB.Query(&chk).ID(res.Id)
+	assert.NoError(err)
+	assert.Equal("sup resource", chk.Name)
+
+	res = &accountResource{Account: Account{Name: "new resource"}}
+	err = DB.Save(res)
+	assert.NoError(err)
+	assert.True(len(res.Id) > 1, "Primary key is set on the embedded struct")
 }
 
 func TestAfterFind(t *testing.T) {
@@ -378,3 +710,1006 @@ func TestUTC(t *testing.T) {
 	assert.NoError(err)
 	assert.Equal(time.UTC, account2.CreatedAt.Location())
 }
+
+func TestRequired(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := DB.Create(&Post{})
+	assert.Error(err)
+	verr, ok := err.(*bondb.ValidationError)
+	assert.True(ok, "Returns a validation error")
+	assert.Len(verr.Fields, 2)
+	assert.Equal("Title", verr.Fields[0].Name)
+	assert.Equal("title", verr.Fields[0].Key)
+	assert.Equal("Body", verr.Fields[1].Name)
+
+	post := &Post{Body: "hi"}
+	err = DB.Save(post)
+	assert.Error(err)
+	assert.Len(post.Id, 0, "Invalid post was not saved")
+
+	// BeforeSave runs before the check and can fill in required fields
+	post.Draft = true
+	err = DB.Save(post)
+	assert.NoError(err)
+	assert.Equal("Untitled", post.Title)
+
+	post.Body = ""
+	err = DB.Query(&post).Where(db.Cond{"_id": post.Id}).Update()
+	assert.Error(err)
+	err = DB.Query(&post).Where(db.Cond{"_id": post.Id}).Update("Draft")
+	assert.NoError(err, "Only updated fields are checked")
+}
+
+func TestValidationRules(t *testing.T) {
+	assert := assert.New(t)
+
+	profile := &Profile{
+		Username: "Bad Name",
+		Email:    "nope",
+		Status:   "deleted",
+		Age:      7,
+		Tags:     []string{"a", "b", "c", "d"},
+	}
+	err := DB.Save(profile)
+	assert.Error(err)
+	verr, ok := err.(*bondb.ValidationError)
+	assert.True(ok, "Returns a validation error")
+
+	rules := map[string]string{}
+	for _, f := range verr.Fields {
+		rules[f.Name] = f.Rule
+	}
+	assert.Equal(map[string]string{
+		"Username": "match=^[a-z0-9_]+$",
+		"Email":    "email",
+		"Status":   "oneof=active|disabled",
+		"Age":      "min=13",
+		"Tags":     "max=3",
+	}, rules, "All violations are reported together")
+
+	country := "CAN"
+	profile = &Profile{Username: "joe", Email: "joe@example.com", Status: "active", Age: 30, Country: &country}
+	err = DB.Save(profile)
+	assert.Error(err)
+
+	country = "CA"
+	err = DB.Save(profile)
+	assert.NoError(err)
+
+	profile.Age = 200
+	err = DB.Query(&profile).Where(db.Cond{"_id": profile.Id}).Update("Age")
+	assert.Error(err)
+
+	profile = &Profile{Username: "ann"}
+	assert.NoError(DB.Save(profile), "Rules don't apply to empty optional fields")
+
+	profile.Code = "abcd"
+	err = DB.Save(profile)
+	assert.Error(err)
+	verr, ok = err.(*bondb.ValidationError)
+	assert.True(ok)
+	assert.Equal([]bondb.FieldError{
+		{Name: "Code", Key: "code", Rule: "len=3"},
+		{Name: "Code", Key: "code", Rule: "match=^[a-zé]{2,3}$"},
+	}, verr.Fields, "Escaped commas are part of the rule")
+
+	profile.Code = "héé"
+	assert.NoError(DB.Save(profile), "len counts characters")
+}
+
+func TestTimestamps(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2015, 6, 1, 12, 0, 0, 0, time.FixedZone("EDT", -4*60*60))
+	DB.Now = func() time.Time { return now }
+	defer func() { DB.Now = time.Now }()
+
+	post := &Post{Title: "Hello", Body: "World"}
+	_, err := DB.Create(post)
+	assert.NoError(err)
+	assert.True(now.Equal(post.CreatedAt))
+	assert.Equal(time.UTC, post.CreatedAt.Location(), "Honours the utc flag")
+	assert.NotNil(post.UpdatedAt)
+	assert.True(now.Equal(*post.UpdatedAt))
+
+	post = &Post{Title: "Hello", Body: "World"}
+	err = DB.Save(post)
+	assert.NoError(err)
+	assert.True(now.Equal(post.CreatedAt))
+	assert.True(now.Equal(*post.UpdatedAt))
+
+	later := now.Add(time.Hour)
+	DB.Now = func() time.Time { return later }
+	err = DB.Save(post)
+	assert.NoError(err)
+	assert.True(now.Equal(post.CreatedAt), "Update leaves the created field alone")
+	assert.True(later.Equal(*post.UpdatedAt))
+
+	latest := later.Add(time.Hour)
+	DB.Now = func() time.Time { return latest }
+	err = DB.Query(&post).Where(db.Cond{"_id": post.Id}).Update()
+	assert.NoError(err)
+	assert.True(now.Equal(post.CreatedAt))
+	assert.True(latest.Equal(*post.UpdatedAt))
+}
+
+func TestOptimisticLocking(t *testing.T) {
+	assert := assert.New(t)
+
+	post := &Post{Title: "Locking", Body: "Optimistic"}
+	err := DB.Save(post)
+	assert.NoError(err)
+	assert.Equal(1, post.Rev)
+
+	var a, b *Post
+	err = DB.Query(&a).ID(post.Id)
+	assert.NoError(err)
+	err = DB.Query(&b).ID(post.Id)
+	assert.NoError(err)
+
+	a.Title = "First"
+	err = DB.Save(a)
+	assert.NoError(err)
+	assert.Equal(2, a.Rev)
+
+	b.Title = "Second"
+	err = DB.Save(b)
+	assert.Equal(bondb.ErrStaleObject, err)
+	assert.Equal(1, b.Rev)
+
+	err = DB.Query(&b).Where(db.Cond{"_id": post.Id}).Update("Title")
+	assert.Equal(bondb.ErrStaleObject, err)
+
+	err = DB.Query(&b).ID(post.Id)
+	assert.NoError(err)
+	b.Title = "Second"
+	err = DB.Query(&b).Where(db.Cond{"_id": post.Id}).Update("Title")
+	assert.NoError(err)
+	assert.Equal(3, b.Rev)
+
+	var chk *Post
+	err = DB.Query(&chk).ID(post.Id)
+	assert.NoError(err)
+	assert.Equal("Second", chk.Title)
+	assert.Equal(3, chk.Rev)
+
+	b.Title = "Outside"
+	err = DB.Query(&b).Where(db.Cond{"title": "Other"}).Update("Title")
+	assert.Equal(db.ErrNoMoreRows, err, "Versioned updates keep the query conditions")
+	assert.Equal(3, b.Rev)
+}
+
+func TestSoftDelete(t *testing.T) {
+	assert := assert.New(t)
+
+	comment := &Comment{Body: "first!"}
+	err := DB.Save(comment)
+	assert.NoError(err)
+	err = DB.Save(&Comment{Body: "second"})
+	assert.NoError(err)
+
+	err = DB.Delete(comment)
+	assert.NoError(err)
+	assert.NotNil(comment.DeletedAt)
+	assert.Equal([]bondb.DeleteKind{bondb.SoftDelete}, comment.deleteKinds)
+
+	var chk *Comment
+	err = DB.Query(&chk).ID(comment.Id)
+	assert.Equal(db.ErrNoMoreRows, err, "Soft deleted records are filtered out")
+
+	var comments []*Comment
+	err = DB.Query(&comments).All()
+	assert.NoError(err)
+	assert.Len(comments, 1)
+
+	err = DB.Query(&comments).WithDeleted().All()
+	assert.NoError(err)
+	assert.Len(comments, 2)
+
+	err = DB.Restore(comment)
+	assert.NoError(err)
+	assert.Nil(comment.DeletedAt)
+	err = DB.Query(&chk).ID(comment.Id)
+	assert.NoError(err)
+	assert.Nil(chk.DeletedAt)
+
+	err = DB.Query(&chk).Where(db.Cond{"_id": comment.Id}).Remove()
+	assert.NoError(err)
+	assert.NotNil(chk.DeletedAt)
+
+	err = DB.Purge(comment)
+	assert.NoError(err)
+	assert.Equal([]bondb.DeleteKind{bondb.SoftDelete, bondb.HardDelete}, comment.deleteKinds)
+	err = DB.Query(&comments).WithDeleted().All()
+	assert.NoError(err)
+	assert.Len(comments, 1, "Purged records are gone")
+}
+
+func TestCollectionNaming(t *testing.T) {
+	assert := assert.New(t)
+
+	col, err := DB.GetCollection(&accountResource{})
+	assert.NoError(err)
+	assert.Equal("accounts", col.Name(), "Inherited from the embedded struct")
+
+	var res *accountResource
+	col, err = DB.GetCollection(res)
+	assert.NoError(err)
+	assert.Equal("accounts", col.Name(), "Nil pointers are named by their type")
+
+	col, err = DB.GetCollection(accountView{})
+	assert.NoError(err)
+	assert.Equal("accounts", col.Name(), "Inherited from an inline field")
+
+	col, err = DB.GetCollection(Account{})
+	assert.NoError(err)
+	assert.Equal("accounts", col.Name(), "Pointer receivers work for values too")
+
+	_, err = DB.GetCollection(Tag{})
+	assert.Equal(bondb.ErrUnknownCollectionName, err)
+
+	DB.RegisterCollection(&Tag{}, "labels")
+	col, err = DB.GetCollection(Tag{})
+	assert.NoError(err)
+	assert.Equal("labels", col.Name())
+
+	DB.CollectionNamer = bondb.PluralSnakeCase
+	defer func() { DB.CollectionNamer = nil }()
+	entry := &AuditEntry{Message: "hello"}
+	err = DB.Save(entry)
+	assert.NoError(err)
+	var entries []AuditEntry
+	err = DB.Query(&entries).All()
+	assert.NoError(err)
+	assert.Len(entries, 1)
+	col, err = DB.GetCollection(entry)
+	assert.NoError(err)
+	assert.Equal("audit_entries", col.Name())
+}
+
+func TestFieldNames(t *testing.T) {
+	assert := assert.New(t)
+
+	err := DB.Save(&Comment{Body: "zzz"})
+	assert.NoError(err)
+	err = DB.Save(&Comment{Body: "aaa"})
+	assert.NoError(err)
+
+	var comments []*Comment
+	err = DB.Query(&comments).Sort("-Body").All()
+	assert.NoError(err)
+	assert.True(len(comments) >= 2)
+	assert.Equal("zzz", comments[0].Body, "Sorted by the Go field name")
+
+	var comment *Comment
+	err = DB.Query(&comment).Where(db.Cond{"Body": "aaa"}).Select("Body").One()
+	assert.NoError(err)
+	assert.Equal("aaa", comment.Body)
+
+	comment.Body = "bbb"
+	err = DB.Query(&comment).Where(db.Cond{"_id": comment.Id}).Update("Body")
+	assert.NoError(err)
+	err = DB.Query(&comment).Where(db.Cond{"body": "bbb"}).One()
+	assert.NoError(err, "Updated the db key rather than the Go name")
+
+	err = DB.Query(&comment).Where(db.Cond{"Bdoy": "bbb"}).One()
+	assert.IsType(&bondb.UnknownFieldError{}, err)
+	err = DB.Query(&comment).Sort("bdoy").One()
+	assert.IsType(&bondb.UnknownFieldError{}, err)
+	err = DB.Query(&comment).Update("Bdoy")
+	assert.IsType(&bondb.UnknownFieldError{}, err)
+}
+
+func TestDirtyTracking(t *testing.T) {
+	assert := assert.New(t)
+
+	page := &Page{Title: "Home", Tags: []string{"a"}}
+	_, err := DB.Changes(page)
+	assert.Equal(bondb.ErrNotTracked, err)
+	err = DB.Save(page)
+	assert.NoError(err)
+
+	var a, b *Page
+	err = DB.Query(&a).ID(page.Id)
+	assert.NoError(err)
+	err = DB.Query(&b).ID(page.Id)
+	assert.NoError(err)
+
+	changes, err := DB.Changes(a)
+	assert.NoError(err)
+	assert.Empty(changes)
+
+	a.Title = "Start"
+	a.Tags[0] = "b"
+	changes, err = DB.Changes(a)
+	assert.NoError(err)
+	assert.Equal([]bondb.Change{
+		{Name: "Title", Key: "title", Old: "Home", New: "Start"},
+		{Name: "Tags", Key: "tags", Old: []string{"a"}, New: []string{"b"}},
+	}, changes)
+
+	// Concurrent changes to other fields aren't clobbered
+	b.Views = 10
+	err = DB.Save(b)
+	assert.NoError(err)
+	err = DB.Save(a)
+	assert.NoError(err)
+
+	changes, err = DB.Changes(a)
+	assert.NoError(err)
+	assert.Empty(changes, "Saving resets the snapshot")
+
+	var chk *Page
+	err = DB.Query(&chk).ID(page.Id)
+	assert.NoError(err)
+	assert.Equal("Start", chk.Title)
+	assert.Equal([]string{"b"}, chk.Tags)
+	assert.Equal(10, chk.Views)
+}
+
+func TestTx(t *testing.T) {
+	assert := assert.New(t)
+
+	called := false
+	err := DB.Tx(func(tx *bondb.Session) error {
+		called = true
+		return nil
+	})
+	assert.Equal(bondb.ErrTxUnsupported, err, "mongo has no transactions")
+	assert.False(called)
+
+	err = DB.Commit()
+	assert.Equal(bondb.ErrNotInTx, err)
+	err = DB.Rollback()
+	assert.Equal(bondb.ErrNotInTx, err)
+}
+
+func TestTxDriver(t *testing.T) {
+	assert := assert.New(t)
+
+	s, err := bondb.NewSession("fakesql", db.Settings{})
+	assert.NoError(err)
+
+	fakeStmts = nil
+	ledger := &Ledger{Id: 1, Balance: 10, Rev: 1}
+	tx, err := s.Begin()
+	assert.NoError(err)
+	assert.NoError(tx.Save(ledger))
+	assert.Equal(2, ledger.Rev)
+	assert.Equal(0, ledger.saved, "AfterSave is deferred until commit")
+	assert.NoError(tx.Commit())
+	assert.Equal(1, ledger.saved)
+	assert.Equal([]string{
+		`tx: UPDATE "ledgers" SET "balance" = ?, "rev" = ? WHERE "id" = ? AND "rev" = ?`,
+		"tx: COMMIT",
+	}, fakeStmts, "Versioned updates run on the transaction")
+
+	fakeStmts = nil
+	err = s.Tx(func(tx *bondb.Session) error {
+		if err := tx.Save(ledger); err != nil {
+			return err
+		}
+		return errors.New("abort")
+	})
+	assert.EqualError(err, "abort")
+	assert.Equal(1, ledger.saved, "AfterSave is dropped on rollback")
+	assert.Equal([]string{
+		`tx: UPDATE "ledgers" SET "balance" = ?, "rev" = ? WHERE "id" = ? AND "rev" = ?`,
+		"tx: ROLLBACK",
+	}, fakeStmts)
+}
+
+// postgresqlSession connects to the bondb_test postgresql database with an
+// empty ledgers table, skipping the test if it isn't available.
+func postgresqlSession(t *testing.T) *bondb.Session {
+	s, err := bondb.NewSession("postgresql", db.Settings{
+		Host:     "127.0.0.1",
+		Database: "bondb_test",
+		User:     "postgres",
+	})
+	if err != nil || s.Ping() != nil {
+		t.Skip("postgresql is not available")
+	}
+
+	conn := s.Driver().(interface {
+		Exec(query string, args ...interface{}) (sql.Result, error)
+	})
+	_, err = conn.Exec(`DROP TABLE IF EXISTS ledgers`)
+	if err == nil {
+		_, err = conn.Exec(`CREATE TABLE ledgers (id bigint PRIMARY KEY, balance integer NOT NULL, rev integer NOT NULL)`)
+	}
+	if err != nil {
+		s.Close()
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestTxDriverPostgresql(t *testing.T) {
+	assert := assert.New(t)
+
+	s := postgresqlSession(t)
+	defer s.Close()
+
+	ledger := &Ledger{Id: 1, Balance: 10}
+	_, err := s.Create(ledger)
+	assert.NoError(err)
+
+	tx, err := s.Begin()
+	assert.NoError(err)
+	ledger.Balance = 20
+	assert.NoError(tx.Save(ledger), "Versioned updates run on the adapter's transaction")
+	assert.NoError(tx.Rollback())
+
+	var stored Ledger
+	assert.NoError(s.Query(&stored).ID(int64(1)))
+	assert.Equal(10, stored.Balance, "The update is rolled back with the transaction")
+}
+
+func TestCreateManyTxPostgresql(t *testing.T) {
+	assert := assert.New(t)
+
+	s := postgresqlSession(t)
+	defer s.Close()
+
+	tx, err := s.Begin()
+	assert.NoError(err)
+	ledgers := []*Ledger{{Id: 1, Balance: 1}, {Id: 1, Balance: 2}, {Id: 2, Balance: 3}}
+	err = tx.CreateMany(ledgers)
+	if assert.IsType(&bondb.BatchError{}, err) {
+		assert.Equal([]int{1}, err.(*bondb.BatchError).Indexes(), "Only the bad row fails within a transaction")
+	}
+	assert.NoError(tx.Commit())
+
+	n, err := s.Query(&Ledger{}).Count()
+	assert.NoError(err)
+	assert.Equal(uint64(2), n)
+}
+
+func TestContext(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx := context.WithValue(context.Background(), ctxKey("actor"), "peter")
+	note := &Note{Text: "hi"}
+	err := DB.WithContext(ctx).Save(note)
+	assert.NoError(err)
+	assert.Equal("peter", note.Author, "Hooks receive the context")
+
+	var chk *Note
+	err = DB.WithContext(ctx).Query(&chk).ID(note.Id)
+	assert.NoError(err)
+	assert.Equal("peter", chk.foundBy)
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	err = DB.WithContext(ctx).Save(&Note{Text: "bye"})
+	assert.Equal(context.Canceled, err)
+	chk = nil
+	err = DB.WithContext(ctx).Query(&chk).ID(note.Id)
+	assert.Equal(context.Canceled, err)
+	assert.Nil(chk)
+	_, err = DB.WithContext(ctx).Query(&chk).Count()
+	assert.Equal(context.Canceled, err)
+
+	assert.Equal(context.Background(), DB.WithContext(nil).Context(), "A nil context is taken as Background")
+}
+
+func TestErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	err := DB.Save(&User{Username: "nopk"})
+	assert.Equal(bondb.ErrNoPrimaryKey, err)
+	err = DB.Delete(&User{Username: "nopk"})
+	assert.Equal(bondb.ErrNoPrimaryKey, err)
+	var user *User
+	err = DB.Query(&user).ID("abc")
+	assert.Equal(bondb.ErrNoPrimaryKey, err)
+
+	err = DB.Save(&badTag{Name: "bad"})
+	assert.Error(err)
+	terr, ok := err.(bondb.ErrInvalidTag)
+	assert.True(ok, "Returns an invalid tag error")
+	assert.Equal("Name", terr.Field)
+	assert.Equal("utc", terr.Flag)
+
+	var bad []*badTag
+	err = DB.Query(&bad).All()
+	assert.IsType(bondb.ErrInvalidTag{}, err)
+
+	err = DB.Query(Account{}).One()
+	assert.Equal(db.ErrExpectingPointer, err)
+}
+
+func TestIDSetter(t *testing.T) {
+	assert := assert.New(t)
+
+	setting := &Setting{Value: "on"}
+	err := DB.Save(setting)
+	assert.NoError(err)
+	assert.Len(setting.Id, 24, "SetID received the new ObjectId")
+}
+
+func TestGenerators(t *testing.T) {
+	assert := assert.New(t)
+
+	invoice := &Invoice{Number: 1}
+	_, err := DB.Create(invoice)
+	assert.NoError(err)
+	assert.Len(invoice.Id, 26)
+
+	var stored Invoice
+	err = DB.Query(&stored).ID(invoice.Id)
+	assert.NoError(err)
+	assert.Equal(int64(1), stored.Number)
+
+	// Save of a new item inserts it with the generated key
+	invoice = &Invoice{Number: 2}
+	err = DB.Save(invoice)
+	assert.NoError(err)
+	n, err := DB.Query(&Invoice{}).Count()
+	assert.NoError(err)
+	assert.Equal(uint64(2), n)
+
+	first, second := &Ticket{Title: "a"}, &Ticket{Title: "b"}
+	assert.NoError(DB.Save(first))
+	assert.NoError(DB.Save(second))
+	assert.Equal(first.Id+1, second.Id)
+
+	DB.RegisterGenerator("order", func(s *bondb.Session, collection string) (interface{}, error) {
+		return collection + "-1", nil
+	})
+	order := &Order{Total: 10}
+	assert.NoError(DB.Save(order))
+	assert.Equal("orders-1", order.Id)
+
+	uuid, err := bondb.GenerateUUID(DB, "orders")
+	assert.NoError(err)
+	assert.Regexp(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`, uuid)
+}
+
+func TestCompositeKey(t *testing.T) {
+	assert := assert.New(t)
+
+	userId, groupId := bson.NewObjectId(), bson.NewObjectId()
+	m := &Membership{UserId: userId, Role: "member"}
+	assert.Equal(bondb.ErrNoPrimaryKey, DB.Delete(m), "partial key is not a key")
+
+	m.GroupId = groupId
+	_, err := DB.Create(m)
+	assert.NoError(err)
+	_, err = DB.Create(&Membership{UserId: userId, GroupId: bson.NewObjectId(), Role: "member"})
+	assert.NoError(err)
+
+	m.Role = "admin"
+	assert.NoError(DB.Save(m))
+
+	var found Membership
+	err = DB.Query(&found).ID([]interface{}{userId, groupId})
+	assert.NoError(err)
+	assert.Equal("admin", found.Role)
+
+	found = Membership{}
+	err = DB.Query(&found).ID(Membership{UserId: userId, GroupId: groupId})
+	assert.NoError(err)
+	assert.Equal("admin", found.Role)
+
+	err = DB.Query(&found).ID([]interface{}{userId})
+	assert.Error(err)
+
+	assert.NoError(DB.Delete(m))
+	n, err := DB.Query(&Membership{}).Where(db.Cond{"UserId": userId}).Count()
+	assert.NoError(err)
+	assert.Equal(uint64(1), n)
+}
+
+func TestUpsert(t *testing.T) {
+	assert := assert.New(t)
+
+	sub := &Subscriber{Email: "joe@example.com", Name: "Joe"}
+	inserted, err := DB.Upsert(sub, "Email")
+	assert.NoError(err)
+	assert.True(inserted)
+	assert.True(sub.Id.Valid(), "Upsert sets the new primary key")
+	created := sub.CreatedAt
+
+	again := &Subscriber{Email: "joe@example.com", Name: "Joseph"}
+	inserted, err = DB.Upsert(again, "email")
+	assert.NoError(err)
+	assert.False(inserted)
+	assert.Equal(sub.Id, again.Id, "Upsert sets the existing primary key")
+	assert.WithinDuration(created, again.CreatedAt, time.Millisecond, "created is only written on insert")
+
+	var stored Subscriber
+	err = DB.Query(&stored).ID(sub.Id)
+	assert.NoError(err)
+	assert.Equal("Joseph", stored.Name)
+
+	_, err = DB.Upsert(&Subscriber{Email: "anon@example.com", Name: "Anon"})
+	assert.Equal(bondb.ErrNoPrimaryKey, err, "The primary key is the default upsert key")
+}
+
+func TestFindOrCreate(t *testing.T) {
+	assert := assert.New(t)
+
+	var sub Subscriber
+	created, err := DB.FindOrCreate(&sub, db.Cond{"Email": "ann@example.com"}, map[string]interface{}{"Name": "Ann"})
+	assert.NoError(err)
+	assert.True(created)
+	assert.True(sub.Id.Valid())
+	assert.Equal("Ann", sub.Name)
+
+	var found Subscriber
+	created, err = DB.FindOrCreate(&found, db.Cond{"email": "ann@example.com"}, map[string]interface{}{"Name": "Other"})
+	assert.NoError(err)
+	assert.False(created)
+	assert.Equal(sub.Id, found.Id)
+	assert.Equal("Ann", found.Name, "defaults don't apply to existing records")
+
+	found = Subscriber{}
+	created, err = DB.FindOrCreate(&found, db.Cond{"Name": "Ann"}, nil)
+	assert.NoError(err, "Existing records aren't validated")
+	assert.False(created)
+	assert.Equal(sub.Id, found.Id)
+
+	_, err = DB.FindOrCreate(&found, db.Cond{"Name": "Nobody"}, nil)
+	assert.IsType(&bondb.ValidationError{}, err, "New records are validated")
+
+	_, err = DB.FindOrCreate(&found, db.Cond{"email >": "a"}, nil)
+	assert.Error(err)
+}
+
+func TestAtomicOps(t *testing.T) {
+	assert := assert.New(t)
+
+	article := &Article{Slug: "hello", Tags: []string{"go"}}
+	assert.NoError(DB.Save(article))
+
+	n, err := DB.Query(&Article{}).Where(db.Cond{"Id": article.Id}).
+		Inc("Views", 2).AddToSet("tags", "go").Apply()
+	assert.NoError(err)
+	assert.Equal(1, n)
+	n, err = DB.Query(&Article{}).Where(db.Cond{"Id": article.Id}).Push("tags", "db").Apply()
+	assert.NoError(err)
+	assert.Equal(1, n)
+
+	_, err = DB.Query(&Article{}).Where(db.Cond{"Id": article.Id}).
+		AddToSet("tags", "go").Push("Tags", "db").Apply()
+	assert.Error(err, "A field takes a single operation")
+
+	var stored Article
+	assert.NoError(DB.Query(&stored).ID(article.Id))
+	assert.Equal(2, stored.Views)
+	assert.Equal([]string{"go", "db"}, stored.Tags)
+	assert.Equal(3, stored.Rev, "Apply increments the version")
+
+	n, err = DB.Query(&Article{}).Where(db.Cond{"Views >=": 2}).Pull("Tags", "go").Apply()
+	assert.NoError(err)
+	assert.Equal(1, n)
+	n, err = DB.Query(&Article{}).Where(db.Cond{"Slug": "hello"}).Unset("Tags").Apply()
+	assert.NoError(err)
+	assert.Equal(1, n)
+
+	stored = Article{}
+	assert.NoError(DB.Query(&stored).ID(article.Id))
+	assert.Empty(stored.Tags)
+
+	n, err = DB.Query(&Article{}).Where(db.Cond{"Slug": "new"}).SetOnInsert("Views", 10).Apply()
+	assert.NoError(err)
+	assert.Equal(1, n, "SetOnInsert inserts a missing record")
+	stored = Article{}
+	assert.NoError(DB.Query(&stored).Where(db.Cond{"Slug": "new"}).One())
+	assert.Equal(10, stored.Views)
+
+	_, err = DB.Query(&Article{}).Inc("Nope", 1).Apply()
+	assert.IsType(&bondb.UnknownFieldError{}, err)
+}
+
+func TestFindAndModify(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, slug := range []string{"a", "b"} {
+		assert.NoError(DB.Save(&Article{Slug: slug, Views: 1}))
+	}
+
+	var article Article
+	err := DB.Query(&article).Where(db.Cond{"Views": 1}).Sort("-Slug").
+		Inc("Views", 1).FindAndModify(nil, bondb.ModifyOptions{ReturnNew: true})
+	assert.NoError(err)
+	assert.Equal("b", article.Slug)
+	assert.Equal(2, article.Views)
+	assert.Equal(2, article.Rev)
+
+	article = Article{}
+	err = DB.Query(&article).Where(db.Cond{"Slug": "a"}).
+		FindAndModify(map[string]interface{}{"Views": 5}, bondb.ModifyOptions{})
+	assert.NoError(err)
+	assert.Equal(1, article.Views, "the old record is returned by default")
+
+	err = DB.Query(&article).Where(db.Cond{"Slug": "c"}).Inc("Views", 1).FindAndModify(nil, bondb.ModifyOptions{})
+	assert.Equal(db.ErrNoMoreRows, err)
+
+	article = Article{}
+	err = DB.Query(&article).Where(db.Cond{"Slug": "c"}).Inc("Views", 1).
+		FindAndModify(nil, bondb.ModifyOptions{Upsert: true, ReturnNew: true})
+	assert.NoError(err)
+	assert.Equal("c", article.Slug)
+	assert.Equal(1, article.Views)
+}
+
+func TestBatch(t *testing.T) {
+	assert := assert.New(t)
+
+	posts := []Post{
+		{Title: "one", Body: "1"},
+		{Title: "two"}, // Body is required
+		{Draft: true, Body: "3"},
+	}
+	err := DB.CreateMany(posts)
+	assert.IsType(&bondb.BatchError{}, err)
+	assert.Equal([]int{1}, err.(*bondb.BatchError).Indexes())
+	assert.IsType(&bondb.ValidationError{}, err.(*bondb.BatchError).Errors[1])
+	assert.True(posts[0].Id.Valid(), "CreateMany sets the primary keys")
+	assert.False(posts[1].Id.Valid())
+	assert.Equal("Untitled", posts[2].Title, "BeforeSave runs per item")
+	assert.Equal(1, posts[2].Rev)
+
+	posts[0].Title = "first"
+	posts[1].Body = "2"
+	assert.NoError(DB.SaveMany(&posts))
+	assert.True(posts[1].Id.Valid())
+	assert.Equal(2, posts[0].Rev, "existing items are updated")
+
+	var stored Post
+	assert.NoError(DB.Query(&stored).ID(posts[0].Id))
+	assert.Equal("first", stored.Title)
+
+	comments := []*Comment{{Body: "a"}, {Body: "b"}}
+	assert.NoError(DB.CreateMany(comments))
+	assert.NoError(DB.DeleteMany(comments))
+	for _, c := range comments {
+		assert.NotNil(c.DeletedAt)
+		assert.Equal([]bondb.DeleteKind{bondb.SoftDelete}, c.deleteKinds)
+	}
+	n, err := DB.Query(&Comment{}).Where(db.Cond{"Body": "a"}).Count()
+	assert.NoError(err)
+	assert.Equal(uint64(0), n)
+
+	err = DB.DeleteMany([]*Comment{{Body: "unsaved"}})
+	assert.Equal(bondb.ErrNoPrimaryKey, err.(*bondb.BatchError).Errors[0])
+}
+
+func TestBulkUpdateRemove(t *testing.T) {
+	assert := assert.New(t)
+
+	for i := 0; i < 3; i++ {
+		_, err := DB.Create(&Note{Text: "bulk"})
+		assert.NoError(err)
+	}
+
+	n, err := DB.Query(&Note{}).Where(db.Cond{"Text": "bulk"}).UpdateAll(map[string]interface{}{"Author": "ann"}, bondb.BulkOptions{})
+	assert.NoError(err)
+	assert.Equal(3, n)
+
+	n, err = DB.Query(&Note{}).Where(db.Cond{"Text": "bulk", "Author !=": "bob"}).
+		UpdateAll(map[string]interface{}{"Author": "ann"}, bondb.BulkOptions{})
+	assert.NoError(err)
+	assert.Equal(3, n, "Operator conditions are passed to the update")
+
+	n, err = DB.Query(&Note{}).Where(db.Or{db.Cond{"Text": "bulk"}, db.Cond{"Text": "none"}}).
+		UpdateAll(map[string]interface{}{"Author": "ann"}, bondb.BulkOptions{})
+	assert.NoError(err)
+	assert.Equal(3, n, "Other conditions are resolved to primary keys")
+
+	ctx := context.WithValue(context.Background(), ctxKey("actor"), "bob")
+	n, err = DB.WithContext(ctx).Query(&Note{}).Where(db.Cond{"Text": "bulk"}).
+		UpdateAll(map[string]interface{}{"Text": "bulk2"}, bondb.BulkOptions{Hooks: true})
+	assert.NoError(err)
+	assert.Equal(3, n)
+
+	var notes []Note
+	assert.NoError(DB.Query(&notes).Where(db.Cond{"Text": "bulk2"}).All())
+	assert.Len(notes, 3)
+	for _, note := range notes {
+		assert.Equal("bob", note.Author, "BeforeSaveContext ran per record")
+	}
+
+	n, err = DB.Query(&Note{}).Where(db.Cond{"Text": "bulk2"}).RemoveAll(bondb.BulkOptions{})
+	assert.NoError(err)
+	assert.Equal(3, n)
+
+	comments := []Comment{{Body: "bulk"}, {Body: "bulk"}}
+	assert.NoError(DB.CreateMany(comments))
+	n, err = DB.Query(&Comment{}).Where(db.Cond{"Body": "bulk"}).RemoveAll(bondb.BulkOptions{Hooks: true})
+	assert.NoError(err)
+	assert.Equal(2, n)
+	count, err := DB.Query(&Comment{}).Where(db.Cond{"Body": "bulk"}).Count()
+	assert.NoError(err)
+	assert.Equal(uint64(0), count)
+	count, err = DB.Query(&Comment{}).WithDeleted().Where(db.Cond{"Body": "bulk"}).Count()
+	assert.NoError(err)
+	assert.Equal(uint64(2), count, "comments are soft deleted")
+}
+
+func TestIter(t *testing.T) {
+	assert := assert.New(t)
+
+	for i := 0; i < 3; i++ {
+		_, err := DB.Create(&Note{Text: "iter"})
+		assert.NoError(err)
+	}
+
+	ctx := context.WithValue(context.Background(), ctxKey("actor"), "eve")
+	iter := DB.WithContext(ctx).Query(&Note{}).Where(db.Cond{"Text": "iter"}).Iter()
+	defer iter.Close()
+	n := 0
+	var note Note
+	for iter.Next(&note) {
+		assert.Equal("eve", note.foundBy, "AfterFindContext runs on each record")
+		n++
+	}
+	assert.NoError(iter.Err())
+	assert.Equal(3, n)
+	assert.False(iter.Next(&note))
+
+	errStop := errors.New("stop")
+	n = 0
+	err := DB.Query(&Note{}).Where(db.Cond{"Text": "iter"}).Each(func(item interface{}) error {
+		n++
+		assert.Equal("iter", item.(*Note).Text)
+		return errStop
+	})
+	assert.Equal(errStop, err)
+	assert.Equal(1, n, "Each stops at the first error")
+
+	err = DB.Query(&Note{}).Where(db.Cond{"Nope": 1}).Each(func(item interface{}) error { return nil })
+	assert.Error(err)
+}
+
+func TestPage(t *testing.T) {
+	assert := assert.New(t)
+
+	for i := 0; i < 5; i++ {
+		_, err := DB.Create(&Note{Text: "page"})
+		assert.NoError(err)
+	}
+
+	seen := map[bson.ObjectId]bool{}
+	token, pages := "", 0
+	for {
+		var notes []Note
+		next, err := DB.Query(&notes).Where(db.Cond{"Text": "page"}).Sort("-Text").After(token).Page(2)
+		assert.NoError(err)
+		if err != nil {
+			break
+		}
+		pages++
+		for _, note := range notes {
+			assert.False(seen[note.Id], "Records don't repeat across pages")
+			seen[note.Id] = true
+		}
+		if next == "" {
+			break
+		}
+		token = next
+	}
+	assert.Equal(3, pages)
+	assert.Len(seen, 5)
+
+	s := DB.WithContext(context.Background())
+	s.PageTokenKey = []byte("secret")
+	var notes []*Note
+	token, err := s.Query(&notes).Where(db.Cond{"Text": "page"}).Page(2)
+	assert.NoError(err)
+	assert.Len(notes, 2)
+	assert.Contains(token, ".")
+	_, err = s.Query(&notes).Where(db.Cond{"Text": "page"}).After(token).Page(2)
+	assert.NoError(err)
+	_, err = s.Query(&notes).Where(db.Cond{"Text": "page"}).After(token + "x").Page(2)
+	assert.Equal(bondb.ErrInvalidPageToken, err)
+	_, err = s.Query(&notes).Where(db.Cond{"Text": "page"}).Sort("Text").After(token).Page(2)
+	assert.Equal(bondb.ErrInvalidPageToken, err, "Tokens are bound to their sort order")
+}
+
+func TestPaginate(t *testing.T) {
+	assert := assert.New(t)
+
+	for i := 0; i < 5; i++ {
+		_, err := DB.Create(&Note{Text: "paginate"})
+		assert.NoError(err)
+	}
+
+	var notes []Note
+	info, err := DB.Query(&notes).Where(db.Cond{"Text": "paginate"}).Limit(1).Paginate(2, 2)
+	assert.NoError(err)
+	assert.Len(notes, 2)
+	assert.Equal(bondb.PageInfo{Page: 2, PerPage: 2, Total: 5, Pages: 3, HasNext: true, HasPrev: true}, info)
+
+	info, err = DB.Query(&notes).Where(db.Cond{"Text": "paginate"}).Paginate(3, 2)
+	assert.NoError(err)
+	assert.Len(notes, 1)
+	assert.False(info.HasNext)
+
+	_, err = DB.Query(&notes).Paginate(0, 2)
+	assert.Error(err)
+}
+
+func TestQueryClone(t *testing.T) {
+	assert := assert.New(t)
+
+	for i := 0; i < 3; i++ {
+		_, err := DB.Create(&Note{Text: "clone"})
+		assert.NoError(err)
+	}
+
+	var notes []Note
+	base := DB.Query(&notes).Where(db.Cond{"Text": "clone"})
+	limited := base.Limit(1)
+	assert.NoError(limited.All())
+	assert.Len(notes, 1)
+	assert.NoError(base.All())
+	assert.Len(notes, 3, "Limit returns a new query")
+
+	none := base.Where(db.Cond{"Text": "none"})
+	count, err := none.Count()
+	assert.NoError(err)
+	assert.Equal(uint64(0), count)
+	count, err = base.Count()
+	assert.NoError(err)
+	assert.Equal(uint64(3), count, "Where returns a new query")
+
+	var a, b Note
+	q := DB.Query(&Note{}).Where(db.Cond{"Text": "clone"}).Sort("Id")
+	c := q.Clone()
+	assert.NoError(q.Next(&a))
+	assert.NoError(c.Next(&b))
+	assert.Equal(a.Id, b.Id, "Clones have their own cursor")
+	q.Close()
+	c.Close()
+}
+
+func TestQueryImmutable(t *testing.T) {
+	assert := assert.New(t)
+
+	for i := 0; i < 2; i++ {
+		_, err := DB.Create(&Note{Text: "immutable"})
+		assert.NoError(err)
+	}
+
+	var notes []Note
+	q := DB.Query(&notes).Where(db.Cond{"Text": "immutable"})
+	q.Where(db.Cond{"Text": "other"})
+	q.Limit(1)
+	assert.NoError(q.All())
+	assert.Len(notes, 2, "Builders leave the receiver unchanged")
+
+	assert.NoError(q.Limit(1).All())
+	assert.Len(notes, 1)
+}
+
+func TestFirstLast(t *testing.T) {
+	assert := assert.New(t)
+
+	var ids []bson.ObjectId
+	for i := 0; i < 3; i++ {
+		oid, err := DB.Create(&Note{Text: "firstlast"})
+		assert.NoError(err)
+		ids = append(ids, oid.(bson.ObjectId))
+	}
+
+	var note Note
+	q := DB.Query(&note).Where(db.Cond{"Text": "firstlast"})
+	assert.NoError(q.First())
+	assert.Equal(ids[0], note.Id, "First orders by primary key")
+	assert.NoError(q.Last())
+	assert.Equal(ids[2], note.Id, "Last orders by primary key descending")
+	assert.NoError(q.Sort("-Id").First())
+	assert.Equal(ids[2], note.Id)
+	assert.NoError(q.Sort("-Id").Last())
+	assert.Equal(ids[0], note.Id, "Last reverses the sort")
+
+	assert.Equal(bondb.ErrMultipleRows, q.Strict().One())
+	assert.NoError(DB.Query(&note).Where(db.Cond{"Id": ids[1]}).Strict().One())
+	assert.Equal(ids[1], note.Id)
+	assert.Equal(db.ErrNoMoreRows, DB.Query(&note).Where(db.Cond{"Text": "none"}).Strict().One())
+}
@@ -0,0 +1,222 @@
+package bondb
+
+import (
+	"reflect"
+
+	"upper.io/db"
+)
+
+// BulkOptions are the options of query.UpdateAll and query.RemoveAll.
+type BulkOptions struct {
+	// Hooks loads every matched record and writes it on its own, running
+	// the save or delete hooks, validation and version checks per record.
+	// Otherwise the records are written by a single statement that bypasses
+	// them.
+	Hooks bool
+}
+
+// UpdateAll sets the fields in values, by db key or Go field name, on all
+// records matching the query, and returns the number of records updated.
+// The updated field is set to the current time.
+//
+// With opts.Hooks, records that fail are reported in a *BatchError while
+// the others are updated.
+func (q *query) UpdateAll(values map[string]interface{}, opts BulkOptions) (int, error) {
+	if q.err != nil {
+		return 0, q.err
+	}
+	if err := q.session.ctxErr(); err != nil {
+		return 0, err
+	}
+	if opts.Hooks {
+		return q.updateEach(values)
+	}
+
+	ops := make([]fieldOp, 0, len(values))
+	set := make(map[string]interface{}, len(values)+1)
+	for _, name := range sortedKeys(values) {
+		key := name
+		if q.sinfo != nil {
+			var err error
+			key, err = q.sinfo.key(name)
+			if err != nil {
+				return 0, err
+			}
+		}
+		ops = append(ops, fieldOp{Op: opSet, Key: key, Value: values[name]})
+		set[key] = values[name]
+	}
+	if err := checkOps(ops); err != nil {
+		return 0, err
+	}
+	ops = q.touchOps(ops)
+
+	drv, err := q.session.driver()
+	if err == db.ErrUnsupported {
+		// NOTE: the count and the update aren't atomic
+		for _, op := range ops {
+			if op.Op == opSet {
+				set[op.Key] = op.Value
+			}
+		}
+		n, err := q.countAll()
+		if err != nil || n == 0 {
+			return 0, err
+		}
+		return n, q.Collection.Find(q.where()...).Update(set)
+	}
+	if err != nil {
+		return 0, err
+	}
+	conds, err := q.driverConds(drv)
+	if err != nil {
+		return 0, err
+	}
+	return eachCond(conds, func(cond db.Cond) (int, error) {
+		return drv.apply(q.Collection.Name(), cond, ops)
+	})
+}
+
+// updateEach loads the records matching the query and updates them one by
+// one, as Save does.
+func (q *query) updateEach(values map[string]interface{}) (int, error) {
+	if q.sinfo == nil {
+		return 0, db.ErrExpectingPointer
+	}
+	if _, err := fieldNames(q.sinfo, sortedKeys(values)); err != nil {
+		return 0, err
+	}
+	items, err := q.loadAll()
+	if err != nil {
+		return 0, err
+	}
+
+	ctx := q.session.Context()
+	errs := make(map[int]error)
+	n := 0
+	for i := 0; i < items.Len(); i++ {
+		itemv := items.Index(i)
+		item := itemv.Interface()
+		err := q.session.ctxErr()
+		if err == nil {
+			err = setFields(itemv.Elem(), q.sinfo, values)
+		}
+		if err == nil {
+			q.session.touch(itemv, false)
+			err = beforeSave(ctx, item)
+		}
+		if err == nil {
+			err = validate(itemv)
+		}
+		var pk db.Cond
+		if err == nil {
+			pk, err = q.session.getPrimaryKey(itemv)
+			if err == nil && pk == nil {
+				err = ErrNoPrimaryKey
+			}
+		}
+		if err == nil {
+			err = q.session.updateChanges(q.Collection, itemv, pk)
+		}
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		snapshot(itemv.Elem())
+		q.session.afterSave(item)
+		n++
+	}
+	return n, batchError(errs)
+}
+
+// RemoveAll deletes all records matching the query, and returns the number
+// of records deleted. Records with a softdelete field are stamped with the
+// current time instead of being removed.
+//
+// With opts.Hooks, the records are deleted as by DeleteMany, and records
+// that fail are reported in a *BatchError while the others are deleted.
+func (q *query) RemoveAll(opts BulkOptions) (int, error) {
+	if q.err != nil {
+		return 0, q.err
+	}
+	if err := q.session.ctxErr(); err != nil {
+		return 0, err
+	}
+	if opts.Hooks {
+		if q.sinfo == nil {
+			return 0, db.ErrExpectingPointer
+		}
+		items, err := q.loadAll()
+		if err != nil {
+			return 0, err
+		}
+		err = q.session.DeleteMany(items.Interface())
+		if batchErr, ok := err.(*BatchError); ok {
+			return items.Len() - len(batchErr.Errors), err
+		}
+		if err != nil {
+			return 0, err
+		}
+		return items.Len(), nil
+	}
+
+	var deleted *fieldInfo
+	if q.sinfo != nil {
+		deleted = q.sinfo.DeletedFieldInfo
+	}
+	if deleted != nil {
+		now := q.session.Now()
+		if deleted.UTC {
+			now = now.UTC()
+		}
+		return q.UpdateAll(map[string]interface{}{deleted.Key: now}, opts)
+	}
+
+	drv, err := q.session.driver()
+	if err == db.ErrUnsupported {
+		// NOTE: the count and the removal aren't atomic
+		n, err := q.countAll()
+		if err != nil || n == 0 {
+			return 0, err
+		}
+		return n, q.Collection.Find(q.where()...).Remove()
+	}
+	if err != nil {
+		return 0, err
+	}
+	conds, err := q.driverConds(drv)
+	if err != nil {
+		return 0, err
+	}
+	return eachCond(conds, func(cond db.Cond) (int, error) {
+		return drv.remove(q.Collection.Name(), cond)
+	})
+}
+
+// loadAll returns a slice of pointers to all records matching the query
+// conditions, regardless of Limit and Skip, with afterFind run on each.
+func (q *query) loadAll() (reflect.Value, error) {
+	items := reflect.New(reflect.SliceOf(reflect.PtrTo(q.sinfo.Zero.Type())))
+	err := q.session.wait(func() error {
+		return q.Collection.Find(q.where()...).All(items.Interface())
+	})
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	ctx := q.session.Context()
+	for i := 0; i < items.Elem().Len(); i++ {
+		afterFind(ctx, items.Elem().Index(i))
+	}
+	return items.Elem(), nil
+}
+
+// countAll counts the records matching the query conditions, regardless of
+// Limit and Skip.
+func (q *query) countAll() (int, error) {
+	var n uint64
+	err := q.session.wait(func() (err error) {
+		n, err = q.Collection.Find(q.where()...).Count()
+		return
+	})
+	return int(n), err
+}
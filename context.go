@@ -0,0 +1,60 @@
+package bondb
+
+import (
+	"context"
+)
+
+// WithContext returns a copy of the session that uses ctx. Operations of
+// the copy return the context's error once it is done, and the Context
+// variants of the hooks receive ctx, ie. to pass on request scoped values.
+// A nil ctx is taken as context.Background().
+//
+// upper.io/db can't interrupt a database call that is already running.
+// Reads return as soon as the context is done and leave the call to finish
+// in the background, writes only check the context before they start.
+func (s *Session) WithContext(ctx context.Context) *Session {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	c := *s
+	c.ctx = ctx
+	return &c
+}
+
+// Context returns the context of the session, which defaults to
+// context.Background().
+func (s *Session) Context() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+func (s *Session) ctxErr() error {
+	if s.ctx == nil {
+		return nil
+	}
+	return s.ctx.Err()
+}
+
+// wait runs fn, returning early with the context's error if the context is
+// done first. fn keeps running in the background in that case, so it must
+// not write to anything the caller can see.
+func (s *Session) wait(fn func() error) error {
+	if s.ctx == nil || s.ctx.Done() == nil {
+		return fn()
+	}
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
@@ -1,5 +1,11 @@
 package bondb
 
+import (
+	"context"
+
+	"upper.io/db"
+)
+
 var DefaultSession *Session
 
 func mustDefaultSession() *Session {
@@ -28,3 +34,47 @@ func Save(item interface{}) error {
 func Delete(item interface{}) error {
 	return mustDefaultSession().Delete(item)
 }
+
+func Purge(item interface{}) error {
+	return mustDefaultSession().Purge(item)
+}
+
+func Restore(item interface{}) error {
+	return mustDefaultSession().Restore(item)
+}
+
+func Changes(item interface{}) ([]Change, error) {
+	return mustDefaultSession().Changes(item)
+}
+
+func Begin() (*Session, error) {
+	return mustDefaultSession().Begin()
+}
+
+func Tx(fn func(tx *Session) error) error {
+	return mustDefaultSession().Tx(fn)
+}
+
+func WithContext(ctx context.Context) *Session {
+	return mustDefaultSession().WithContext(ctx)
+}
+
+func Upsert(item interface{}, keyFields ...string) (bool, error) {
+	return mustDefaultSession().Upsert(item, keyFields...)
+}
+
+func FindOrCreate(dst interface{}, cond db.Cond, defaults map[string]interface{}) (bool, error) {
+	return mustDefaultSession().FindOrCreate(dst, cond, defaults)
+}
+
+func CreateMany(items interface{}) error {
+	return mustDefaultSession().CreateMany(items)
+}
+
+func SaveMany(items interface{}) error {
+	return mustDefaultSession().SaveMany(items)
+}
+
+func DeleteMany(items interface{}) error {
+	return mustDefaultSession().DeleteMany(items)
+}
@@ -0,0 +1,170 @@
+package bondb
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/mgo.v2"
+	"upper.io/db"
+)
+
+// driver runs operations that upper.io/db doesn't expose in an adapter
+// agnostic way, ie. reporting how many records an update matched. It works
+// directly on the connection returned by db.Database.Driver(), or on the
+// transaction of a transaction's session.
+//
+// Conditions passed to a driver are plain conditions, whose keys are a field
+// optionally followed by one of the operators of condOps. A nil value
+// matches null, and a list value, other than []byte, any of its elements,
+// or none of them with != and NOT IN.
+type driver interface {
+	// update sets values on the records of col matching cond, and returns
+	// the number of matched records.
+	update(col string, cond db.Cond, values map[string]interface{}) (int, error)
+
+	// remove deletes the records of col matching cond, and returns the
+	// number of deleted records.
+	remove(col string, cond db.Cond) (int, error)
+
+	// nextSeq increments and returns the counter name stored in col.
+	nextSeq(col, name string) (int64, error)
+
+	// upsert runs u on col atomically, and returns whether the record was
+	// inserted along with its values for u.returning. It returns
+	// db.ErrUnsupported if the database has no native upsert.
+	upsert(col string, u *upsert) (bool, map[string]interface{}, error)
+
+	// apply runs ops on the records of col matching cond, and returns the
+	// number of matched records. It returns an *UnsupportedOpError for ops
+	// the database can't express.
+	apply(col string, cond db.Cond, ops []fieldOp) (int, error)
+
+	// findAndModify runs ops on the first record of col matching cond in
+	// the sort order, and decodes the record into dst. It returns whether
+	// dst was decoded, and db.ErrNoMoreRows if no record matched.
+	findAndModify(col string, cond db.Cond, sort []string, ops []fieldOp, opts ModifyOptions, dst interface{}) (bool, error)
+
+	// insertMany inserts items, addressable structs described by sinfo, into
+	// col as one batch. It returns the primary key of each item, nil where
+	// unknown, and the errors of the items that failed by their index in
+	// items. An error is returned when the outcome of the batch is unknown.
+	insertMany(col string, sinfo *structInfo, items []reflect.Value) ([]interface{}, map[int]error, error)
+
+	// batchSize returns the number of records, with the given number of
+	// fields, written per batch.
+	batchSize(fields int) int
+}
+
+// driver returns the driver for the session's adapter, or db.ErrUnsupported
+// if the adapter's connection isn't one bondb knows how to use.
+//
+// The connection a transaction returns from Driver() is the pool it was
+// begun on, so a transaction's driver runs on the *sql.Tx the SQL adapters'
+// transaction types wrap, or on the transaction itself if it can execute
+// statements. Others return ErrTxUnsupported, rather than writing outside
+// the transaction.
+func (s *Session) driver() (driver, error) {
+	if s.tx != nil {
+		if tx := sqlTx(s.tx.Tx); tx != nil {
+			return newSQLDriver(s.adapter, tx), nil
+		}
+		if conn, ok := s.tx.Tx.(sqlExecer); ok {
+			return newSQLDriver(s.adapter, conn), nil
+		}
+		return nil, ErrTxUnsupported
+	}
+	switch conn := s.Driver().(type) {
+	case *mgo.Session:
+		return &mongoDriver{session: conn, database: s.Name()}, nil
+	case sqlExecer:
+		return newSQLDriver(s.adapter, conn), nil
+	}
+	return nil, db.ErrUnsupported
+}
+
+// condOps maps the operators a driver condition key may have to their
+// canonical form.
+var condOps = map[string]string{
+	"=":      "=",
+	"==":     "=",
+	"!=":     "!=",
+	"<>":     "!=",
+	"<":      "<",
+	"<=":     "<=",
+	">":      ">",
+	">=":     ">=",
+	"IN":     "IN",
+	"NOT IN": "NOT IN",
+}
+
+// condKey splits a driver condition key into its field and canonical
+// operator, "=" if it has none, and reports whether the operator is known.
+func condKey(k string) (field, op string, ok bool) {
+	chunks := strings.SplitN(strings.TrimSpace(k), " ", 2)
+	if len(chunks) == 1 {
+		return chunks[0], "=", true
+	}
+	op, ok = condOps[strings.ToUpper(strings.Join(strings.Fields(chunks[1]), " "))]
+	return chunks[0], op, ok
+}
+
+// isPlainCond reports whether k and v are a condition a driver can express.
+func isPlainCond(k string, v interface{}) bool {
+	field, op, ok := condKey(k)
+	if !ok || strings.Contains(field, "$") {
+		return false
+	}
+	switch v.(type) {
+	case db.Raw, db.Func:
+		return false
+	}
+	switch op {
+	case "=", "!=":
+		return true
+	case "IN", "NOT IN":
+		return isList(v)
+	}
+	return v != nil && !isList(v)
+}
+
+// fieldValues returns the db values of the fields of v keyed by their db
+// key, leaving out the primary key. When names is non-empty, only the
+// fields with those Go names are returned.
+func fieldValues(v reflect.Value, sinfo *structInfo, names ...string) map[string]interface{} {
+	values := make(map[string]interface{}, len(sinfo.FieldsList))
+	for _, fi := range sinfo.FieldsList {
+		if fi.PK {
+			continue
+		}
+		if len(names) > 0 && !containsString(names, fi.Name) {
+			continue
+		}
+		values[fi.Key] = v.FieldByIndex(fi.Index).Interface()
+	}
+	return values
+}
+
+// isList reports whether v is a slice or array of values, which a condition
+// matches any of.
+func isList(v interface{}) bool {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Slice:
+		return rv.Type().Elem().Kind() != reflect.Uint8
+	case reflect.Array:
+		return true
+	}
+	return false
+}
+
+// sortedKeys returns the keys of m in order, so generated statements are
+// stable.
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
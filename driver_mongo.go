@@ -0,0 +1,235 @@
+package bondb
+
+import (
+	"reflect"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"upper.io/db"
+)
+
+type mongoDriver struct {
+	session  *mgo.Session
+	database string
+}
+
+// mongoOps maps the canonical operators of driver conditions to mongo's.
+var mongoOps = map[string]string{
+	"=":      "$eq",
+	"!=":     "$ne",
+	"<":      "$lt",
+	"<=":     "$lte",
+	">":      "$gt",
+	">=":     "$gte",
+	"IN":     "$in",
+	"NOT IN": "$nin",
+}
+
+// mongoCond converts a driver condition to a mongo query.
+func mongoCond(cond db.Cond) bson.M {
+	q := make(bson.M, len(cond))
+	ops := make(map[string]bson.M)
+	for k, v := range cond {
+		field, op, _ := condKey(k)
+		switch {
+		case op == "=" && isList(v):
+			op = "IN"
+		case op == "!=" && isList(v):
+			op = "NOT IN"
+		case op == "=":
+			q[field] = v
+			continue
+		}
+		if ops[field] == nil {
+			ops[field] = bson.M{}
+		}
+		ops[field][mongoOps[op]] = v
+	}
+	for field, m := range ops {
+		if v, ok := q[field]; ok {
+			m["$eq"] = v
+		}
+		q[field] = m
+	}
+	return q
+}
+
+func (d *mongoDriver) update(col string, cond db.Cond, values map[string]interface{}) (int, error) {
+	c := d.session.DB(d.database).C(col)
+	info, err := c.UpdateAll(mongoCond(cond), bson.M{"$set": values})
+	if err != nil {
+		return 0, err
+	}
+	return info.Matched, nil
+}
+
+func (d *mongoDriver) remove(col string, cond db.Cond) (int, error) {
+	c := d.session.DB(d.database).C(col)
+	info, err := c.RemoveAll(mongoCond(cond))
+	if err != nil {
+		return 0, err
+	}
+	return info.Removed, nil
+}
+
+func (d *mongoDriver) nextSeq(col, name string) (int64, error) {
+	c := d.session.DB(d.database).C(col)
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	_, err := c.FindId(name).Apply(mgo.Change{
+		Update:    bson.M{"$inc": bson.M{"seq": 1}},
+		Upsert:    true,
+		ReturnNew: true,
+	}, &counter)
+	if err != nil {
+		return 0, err
+	}
+	return counter.Seq, nil
+}
+
+func (d *mongoDriver) upsert(col string, u *upsert) (bool, map[string]interface{}, error) {
+	c := d.session.DB(d.database).C(col)
+	update := bson.M{}
+	if len(u.set) > 0 {
+		update["$set"] = u.set
+	}
+	if len(u.insert) > 0 {
+		update["$setOnInsert"] = u.insert
+	}
+	if u.version != "" {
+		update["$inc"] = bson.M{u.version: 1}
+	}
+	var doc bson.M
+	info, err := c.Find(mongoCond(u.keys)).Apply(mgo.Change{
+		Update:    update,
+		Upsert:    true,
+		ReturnNew: true,
+	}, &doc)
+	if err != nil {
+		return false, nil, err
+	}
+	returned := make(map[string]interface{}, len(u.returning))
+	for _, k := range u.returning {
+		if v, ok := doc[k]; ok {
+			returned[k] = v
+		}
+	}
+	return info.UpsertedId != nil, returned, nil
+}
+
+// mongoUpdate converts ops to a mongo update document, and reports whether
+// they include an insert.
+func mongoUpdate(ops []fieldOp) (bson.M, bool) {
+	update := bson.M{}
+	upsert := false
+	for _, op := range ops {
+		name := "$" + op.Op
+		fields, ok := update[name].(bson.M)
+		if !ok {
+			fields = bson.M{}
+			update[name] = fields
+		}
+		fields[op.Key] = op.Value
+		upsert = upsert || op.Op == opSetOnInsert
+	}
+	return update, upsert
+}
+
+func (d *mongoDriver) apply(col string, cond db.Cond, ops []fieldOp) (int, error) {
+	c := d.session.DB(d.database).C(col)
+	update, upsert := mongoUpdate(ops)
+	if upsert {
+		info, err := c.Upsert(mongoCond(cond), update)
+		if err != nil {
+			return 0, err
+		}
+		if info.UpsertedId != nil {
+			return 1, nil
+		}
+		return info.Matched, nil
+	}
+	info, err := c.UpdateAll(mongoCond(cond), update)
+	if err != nil {
+		return 0, err
+	}
+	return info.Matched, nil
+}
+
+func (d *mongoDriver) findAndModify(col string, cond db.Cond, sort []string, ops []fieldOp, opts ModifyOptions, dst interface{}) (bool, error) {
+	c := d.session.DB(d.database).C(col)
+	query := c.Find(mongoCond(cond))
+	if len(sort) > 0 {
+		query = query.Sort(sort...)
+	}
+	update, _ := mongoUpdate(ops)
+	var doc bson.Raw
+	_, err := query.Apply(mgo.Change{
+		Update:    update,
+		Upsert:    opts.Upsert,
+		ReturnNew: opts.ReturnNew,
+	}, &doc)
+	if err == mgo.ErrNotFound {
+		return false, db.ErrNoMoreRows
+	}
+	if err != nil {
+		return false, err
+	}
+	if doc.Kind == 0 {
+		return false, nil // inserted, and the old record was asked for
+	}
+	return true, doc.Unmarshal(dst)
+}
+
+var objectIdType = reflect.TypeOf(bson.ObjectId(""))
+
+// insertMany runs an unordered bulk insert. Zero bson.ObjectId primary keys
+// are generated beforehand, so they can be returned.
+func (d *mongoDriver) insertMany(col string, sinfo *structInfo, items []reflect.Value) ([]interface{}, map[int]error, error) {
+	c := d.session.DB(d.database).C(col)
+	fi := sinfo.PKFieldInfo
+	ids := make([]interface{}, len(items))
+	generated := make([]bool, len(items))
+	docs := make([]interface{}, len(items))
+	for i, v := range items {
+		if fi != nil {
+			pk := v.FieldByIndex(fi.Index)
+			if pk.Type() == objectIdType && isZero(pk) {
+				pk.Set(reflect.ValueOf(bson.NewObjectId()))
+				generated[i] = true
+			}
+			if !isZero(pk) {
+				ids[i] = pk.Interface()
+			}
+		}
+		docs[i] = v.Addr().Interface()
+	}
+
+	b := c.Bulk()
+	b.Unordered()
+	b.Insert(docs...)
+	_, err := b.Run()
+	failed := make(map[int]error)
+	if bulkErr, ok := err.(*mgo.BulkError); ok {
+		for _, e := range bulkErr.Cases() {
+			if e.Index < 0 {
+				return nil, nil, e.Err
+			}
+			failed[e.Index] = e.Err
+		}
+	} else if err != nil {
+		return nil, nil, err
+	}
+	for i := range failed {
+		ids[i] = nil
+		if generated[i] {
+			items[i].FieldByIndex(fi.Index).Set(fi.Zero)
+		}
+	}
+	return ids, failed, nil
+}
+
+// batchSize is mongo's maximum number of writes per batch.
+func (d *mongoDriver) batchSize(fields int) int {
+	return 1000
+}
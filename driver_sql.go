@@ -0,0 +1,577 @@
+package bondb
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"upper.io/db"
+)
+
+// sqlExecer is satisfied by *sql.DB and *sql.Tx, as well as the sqlx types
+// the upper.io/db SQL adapters return from Driver().
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+var sqlTxType = reflect.TypeOf((*sql.Tx)(nil))
+
+// sqlTx returns the *sql.Tx wrapped by tx, or nil. The transaction types of
+// the upper.io/db SQL adapters embed a *sqlx.Tx, itself embedding the
+// *sql.Tx, along with methods of their own that may shadow its Exec.
+func sqlTx(tx db.Tx) *sql.Tx {
+	return findSQLTx(reflect.ValueOf(tx), 0)
+}
+
+// findSQLTx looks for a *sql.Tx in v and its exported embedded fields.
+func findSQLTx(v reflect.Value, depth int) *sql.Tx {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		if v.Type() == sqlTxType {
+			return v.Interface().(*sql.Tx)
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct || depth > 4 {
+		return nil
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if f := t.Field(i); !f.Anonymous || f.PkgPath != "" {
+			continue
+		}
+		if tx := findSQLTx(v.Field(i), depth+1); tx != nil {
+			return tx
+		}
+	}
+	return nil
+}
+
+type sqlDriver struct {
+	conn    sqlExecer
+	adapter string
+}
+
+func newSQLDriver(adapter string, conn sqlExecer) *sqlDriver {
+	return &sqlDriver{conn: conn, adapter: adapter}
+}
+
+// quote quotes an identifier for the adapter.
+func (d *sqlDriver) quote(name string) string {
+	if d.adapter == "mysql" {
+		return "`" + name + "`"
+	}
+	return `"` + name + `"`
+}
+
+// placeholder returns the n-th (1-based) bind parameter for the adapter.
+func (d *sqlDriver) placeholder(n int) string {
+	if d.adapter == "postgresql" {
+		return fmt.Sprintf("$%d", n)
+	}
+	return "?"
+}
+
+// where builds a WHERE clause for cond, numbering placeholders after the
+// given args.
+func (d *sqlDriver) where(cond db.Cond, args []interface{}) (string, []interface{}) {
+	if len(cond) == 0 {
+		return "", args
+	}
+	clauses := make([]string, 0, len(cond))
+	for _, k := range sortedKeys(cond) {
+		v := cond[k]
+		field, op, _ := condKey(k)
+		col := d.quote(field)
+		not := op == "!=" || op == "NOT IN"
+		switch {
+		case v == nil && not:
+			clauses = append(clauses, col+" IS NOT NULL")
+		case v == nil:
+			clauses = append(clauses, col+" IS NULL")
+		case isList(v):
+			list := reflect.ValueOf(v)
+			if list.Len() == 0 {
+				if not {
+					clauses = append(clauses, "1 = 1")
+				} else {
+					clauses = append(clauses, "1 = 0")
+				}
+				continue
+			}
+			params := make([]string, list.Len())
+			for i := range params {
+				args = append(args, list.Index(i).Interface())
+				params[i] = d.placeholder(len(args))
+			}
+			in := " IN ("
+			if not {
+				in = " NOT IN ("
+			}
+			clauses = append(clauses, col+in+strings.Join(params, ", ")+")")
+		default:
+			args = append(args, v)
+			clauses = append(clauses, col+" "+op+" "+d.placeholder(len(args)))
+		}
+	}
+	return " WHERE " + strings.Join(clauses, " AND "), args
+}
+
+func (d *sqlDriver) update(table string, cond db.Cond, values map[string]interface{}) (int, error) {
+	var args []interface{}
+	sets := make([]string, 0, len(values))
+	for _, k := range sortedKeys(values) {
+		args = append(args, values[k])
+		sets = append(sets, d.quote(k)+" = "+d.placeholder(len(args)))
+	}
+	where, args := d.where(cond, args)
+	query := "UPDATE " + d.quote(table) + " SET " + strings.Join(sets, ", ") + where
+
+	res, err := d.conn.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	// NOTE: mysql reports changed rather than matched rows by default
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (d *sqlDriver) remove(table string, cond db.Cond) (int, error) {
+	where, args := d.where(cond, nil)
+	res, err := d.conn.Exec("DELETE FROM "+d.quote(table)+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// nextSeq isn't supported, SQL databases have their own auto increment.
+func (d *sqlDriver) nextSeq(table, name string) (int64, error) {
+	return 0, db.ErrUnsupported
+}
+
+// upsert is supported on postgresql with INSERT ... ON CONFLICT, which
+// requires a unique constraint on the keys.
+func (d *sqlDriver) upsert(table string, u *upsert) (bool, map[string]interface{}, error) {
+	if d.adapter != "postgresql" {
+		return false, nil, db.ErrUnsupported
+	}
+	values := make(map[string]interface{}, len(u.insert)+len(u.set)+1)
+	for k, v := range u.insert {
+		values[k] = v
+	}
+	for k, v := range u.set {
+		values[k] = v
+	}
+	if u.version != "" {
+		values[u.version] = 1
+	}
+
+	var args []interface{}
+	cols := make([]string, 0, len(values))
+	params := make([]string, 0, len(values))
+	for _, k := range sortedKeys(values) {
+		args = append(args, values[k])
+		cols = append(cols, d.quote(k))
+		params = append(params, d.placeholder(len(args)))
+	}
+	keys := sortedKeys(u.keys)
+	for i, k := range keys {
+		keys[i] = d.quote(k)
+	}
+	sets := make([]string, 0, len(u.set)+1)
+	for _, k := range sortedKeys(u.set) {
+		sets = append(sets, d.quote(k)+" = EXCLUDED."+d.quote(k))
+	}
+	if u.version != "" {
+		sets = append(sets, d.quote(u.version)+" = "+d.quote(table)+"."+d.quote(u.version)+" + 1")
+	}
+	if len(sets) == 0 {
+		// DO NOTHING wouldn't return the existing row
+		sets = append(sets, keys[0]+" = EXCLUDED."+keys[0])
+	}
+	returning := make([]string, 0, len(u.returning)+1)
+	for _, k := range u.returning {
+		returning = append(returning, d.quote(k))
+	}
+	returning = append(returning, "(xmax = 0)") // true for inserted rows
+
+	query := "INSERT INTO " + d.quote(table) + " (" + strings.Join(cols, ", ") + ") VALUES (" + strings.Join(params, ", ") + ")" +
+		" ON CONFLICT (" + strings.Join(keys, ", ") + ") DO UPDATE SET " + strings.Join(sets, ", ") +
+		" RETURNING " + strings.Join(returning, ", ")
+
+	dest := make([]interface{}, len(returning))
+	vals := make([]interface{}, len(u.returning))
+	for i := range vals {
+		dest[i] = &vals[i]
+	}
+	var inserted bool
+	dest[len(vals)] = &inserted
+	err := d.conn.QueryRow(query, args...).Scan(dest...)
+	if err != nil {
+		return false, nil, err
+	}
+	returned := make(map[string]interface{}, len(vals))
+	for i, k := range u.returning {
+		returned[k] = vals[i]
+	}
+	return inserted, returned, nil
+}
+
+// apply supports set, inc and unset, and the array operations on postgresql.
+func (d *sqlDriver) apply(table string, cond db.Cond, ops []fieldOp) (int, error) {
+	if hasOp(ops, opSetOnInsert) {
+		return 0, &UnsupportedOpError{Op: opSetOnInsert, Adapter: d.adapter}
+	}
+	sets, args, err := d.sets(ops, nil)
+	if err != nil {
+		return 0, err
+	}
+	where, args := d.where(cond, args)
+	query := "UPDATE " + d.quote(table) + " SET " + strings.Join(sets, ", ") + where
+
+	res, err := d.conn.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// sets builds the SET assignments of an UPDATE for ops, numbering
+// placeholders after the given args. SetOnInsert ops are left out.
+func (d *sqlDriver) sets(ops []fieldOp, args []interface{}) ([]string, []interface{}, error) {
+	sets := make([]string, 0, len(ops))
+	arrays := d.adapter == "postgresql"
+	for _, op := range ops {
+		col := d.quote(op.Key)
+		switch {
+		case op.Op == opSetOnInsert:
+			continue
+		case op.Op == opSet:
+			args = append(args, op.Value)
+			sets = append(sets, col+" = "+d.placeholder(len(args)))
+		case op.Op == opInc:
+			args = append(args, op.Value)
+			sets = append(sets, col+" = "+col+" + "+d.placeholder(len(args)))
+		case op.Op == opUnset:
+			sets = append(sets, col+" = NULL")
+		case op.Op == opPush && arrays:
+			args = append(args, op.Value)
+			sets = append(sets, col+" = array_append("+col+", "+d.placeholder(len(args))+")")
+		case op.Op == opPull && arrays:
+			args = append(args, op.Value)
+			sets = append(sets, col+" = array_remove("+col+", "+d.placeholder(len(args))+")")
+		case op.Op == opAddToSet && arrays:
+			args = append(args, op.Value)
+			p := d.placeholder(len(args))
+			sets = append(sets, col+" = CASE WHEN "+p+" = ANY("+col+") THEN "+col+" ELSE array_append("+col+", "+p+") END")
+		default:
+			return nil, nil, &UnsupportedOpError{Op: op.Op, Adapter: d.adapter}
+		}
+	}
+	return sets, args, nil
+}
+
+// sqlBeginner is satisfied by *sql.DB and *sqlx.DB, but not by the
+// transaction types.
+type sqlBeginner interface {
+	Begin() (*sql.Tx, error)
+}
+
+// findAndModify is supported on postgresql, by locking the first matching
+// record in a transaction and updating it with RETURNING. dst must point to
+// a struct, and ops must update a column of the matching record, which
+// SetOnInsert alone doesn't.
+func (d *sqlDriver) findAndModify(table string, cond db.Cond, sort []string, ops []fieldOp, opts ModifyOptions, dst interface{}) (bool, error) {
+	if d.adapter != "postgresql" {
+		return false, &UnsupportedOpError{Op: "findAndModify", Adapter: d.adapter}
+	}
+	v := indirectStruct(reflect.ValueOf(dst))
+	if !v.IsValid() {
+		return false, db.ErrExpectingPointer
+	}
+	sinfo, err := getStructInfo(v.Type())
+	if err != nil {
+		return false, err
+	}
+	if len(sinfo.PKFieldsList) == 0 {
+		return false, ErrNoPrimaryKey
+	}
+	sets, args, err := d.sets(ops, nil)
+	if err != nil {
+		return false, err
+	}
+	if len(sets) == 0 {
+		return false, errors.New("bondb: findAndModify requires an operation other than SetOnInsert")
+	}
+
+	// the session's own transaction is used as is
+	conn := d.conn
+	var tx *sql.Tx
+	if b, ok := conn.(sqlBeginner); ok {
+		tx, err = b.Begin()
+		if err != nil {
+			return false, err
+		}
+		defer tx.Rollback()
+		conn = tx
+	}
+	commit := func() error {
+		if tx != nil {
+			return tx.Commit()
+		}
+		return nil
+	}
+
+	// cols are the columns of dst, scanned into fields of v
+	cols := make([]string, len(sinfo.FieldsList))
+	fields := make([]interface{}, len(sinfo.FieldsList))
+	for i, fi := range sinfo.FieldsList {
+		cols[i] = d.quote(fi.Key)
+		fields[i] = v.FieldByIndex(fi.Index).Addr().Interface()
+	}
+	returning := " RETURNING " + strings.Join(cols, ", ")
+
+	// lock the record, reading it into dst unless the new one is wanted
+	where, whereArgs := d.where(cond, nil)
+	query := "SELECT " + strings.Join(cols, ", ") + " FROM " + d.quote(table) + where + d.orderBy(sort) + " LIMIT 1 FOR UPDATE"
+	old := reflect.New(v.Type())
+	oldFields := make([]interface{}, len(sinfo.FieldsList))
+	for i, fi := range sinfo.FieldsList {
+		oldFields[i] = old.Elem().FieldByIndex(fi.Index).Addr().Interface()
+	}
+	err = conn.QueryRow(query, whereArgs...).Scan(oldFields...)
+	if err == sql.ErrNoRows {
+		if !opts.Upsert {
+			return false, db.ErrNoMoreRows
+		}
+		found, err := d.insertReturning(conn, table, cond, ops, opts, returning, fields)
+		if err != nil {
+			return false, err
+		}
+		return found, commit()
+	}
+	if err != nil {
+		return false, err
+	}
+
+	pk := make(db.Cond, len(sinfo.PKFieldsList))
+	for _, fi := range sinfo.PKFieldsList {
+		pk[fi.Key] = old.Elem().FieldByIndex(fi.Index).Interface()
+	}
+	where, args = d.where(pk, args)
+	query = "UPDATE " + d.quote(table) + " SET " + strings.Join(sets, ", ") + where
+	if opts.ReturnNew {
+		err = conn.QueryRow(query+returning, args...).Scan(fields...)
+	} else {
+		_, err = conn.Exec(query, args...)
+		v.Set(old.Elem())
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, commit()
+}
+
+// insertReturning inserts the record of an upserting findAndModify, made of
+// the equality conditions and the values of ops.
+func (d *sqlDriver) insertReturning(conn sqlExecer, table string, cond db.Cond, ops []fieldOp, opts ModifyOptions, returning string, fields []interface{}) (bool, error) {
+	exprs := make(map[string]string)
+	values := make(map[string]interface{})
+	for k, v := range cond {
+		if v != nil && !isList(v) {
+			exprs[k], values[k] = "", v
+		}
+	}
+	for _, op := range ops {
+		switch op.Op {
+		case opSet, opSetOnInsert, opInc:
+			exprs[op.Key], values[op.Key] = "", op.Value
+		case opPush, opAddToSet:
+			exprs[op.Key], values[op.Key] = "ARRAY[%s]", op.Value
+		}
+	}
+
+	var args []interface{}
+	cols := make([]string, 0, len(values))
+	params := make([]string, 0, len(values))
+	for _, k := range sortedKeys(values) {
+		args = append(args, values[k])
+		p := d.placeholder(len(args))
+		if exprs[k] != "" {
+			p = fmt.Sprintf(exprs[k], p)
+		}
+		cols = append(cols, d.quote(k))
+		params = append(params, p)
+	}
+	query := "INSERT INTO " + d.quote(table) + " (" + strings.Join(cols, ", ") + ") VALUES (" + strings.Join(params, ", ") + ")"
+
+	var err error
+	if opts.ReturnNew {
+		err = conn.QueryRow(query+returning, args...).Scan(fields...)
+	} else {
+		_, err = conn.Exec(query, args...)
+	}
+	if err != nil {
+		return false, err
+	}
+	return opts.ReturnNew, nil
+}
+
+// orderBy builds an ORDER BY clause for sort keys prefixed with "-" for
+// descending order.
+func (d *sqlDriver) orderBy(sort []string) string {
+	if len(sort) == 0 {
+		return ""
+	}
+	terms := make([]string, len(sort))
+	for i, key := range sort {
+		if strings.HasPrefix(key, "-") {
+			terms[i] = d.quote(key[1:]) + " DESC"
+		} else {
+			terms[i] = d.quote(key) + " ASC"
+		}
+	}
+	return " ORDER BY " + strings.Join(terms, ", ")
+}
+
+// insertMany is supported on postgresql with a multi-row INSERT, returning
+// the primary key of a single field key. A failed batch inserts nothing,
+// so its rows are retried one by one to find those that fail. Within a
+// transaction, each insert runs in a savepoint, as a failed statement
+// would otherwise abort the transaction.
+func (d *sqlDriver) insertMany(table string, sinfo *structInfo, items []reflect.Value) ([]interface{}, map[int]error, error) {
+	if d.adapter != "postgresql" {
+		return nil, nil, db.ErrUnsupported
+	}
+	rows := make([]map[string]interface{}, len(items))
+	cols := make(map[string]interface{})
+	for i, v := range items {
+		rows[i] = fieldValues(v, sinfo)
+		for _, fi := range sinfo.PKFieldsList {
+			if pk := v.FieldByIndex(fi.Index); !isZero(pk) {
+				rows[i][fi.Key] = pk.Interface() // zero keys are left to the database
+			}
+		}
+		for k := range rows[i] {
+			cols[k] = nil
+		}
+	}
+	keys := sortedKeys(cols)
+
+	var ids []interface{}
+	err, spErr := d.savepoint(func() (err error) {
+		ids, err = d.insertRows(table, sinfo, keys, rows)
+		return
+	})
+	if spErr != nil {
+		return nil, nil, spErr
+	}
+	if err == nil {
+		return ids, nil, nil
+	}
+	ids = make([]interface{}, len(items))
+	failed := make(map[int]error)
+	for i := range rows {
+		var id []interface{}
+		err, spErr := d.savepoint(func() (err error) {
+			id, err = d.insertRows(table, sinfo, keys, rows[i:i+1])
+			return
+		})
+		if spErr != nil {
+			return nil, nil, spErr
+		}
+		if err != nil {
+			failed[i] = err
+			continue
+		}
+		ids[i] = id[0]
+	}
+	return ids, failed, nil
+}
+
+// savepoint runs fn, within a savepoint when the driver runs on a
+// transaction, so that fn failing leaves the transaction usable. It returns
+// the error of fn, and spErr if the savepoint itself failed, which leaves
+// the transaction in an unknown state.
+func (d *sqlDriver) savepoint(fn func() error) (err, spErr error) {
+	if _, ok := d.conn.(sqlBeginner); ok {
+		return fn(), nil
+	}
+	if _, spErr = d.conn.Exec("SAVEPOINT bondb_insert"); spErr != nil {
+		return nil, spErr
+	}
+	if err = fn(); err != nil {
+		_, spErr = d.conn.Exec("ROLLBACK TO SAVEPOINT bondb_insert")
+		return err, spErr
+	}
+	_, spErr = d.conn.Exec("RELEASE SAVEPOINT bondb_insert")
+	return nil, spErr
+}
+
+// insertRows inserts rows with the given columns, using DEFAULT for the
+// columns a row has no value for, and returns their primary keys.
+func (d *sqlDriver) insertRows(table string, sinfo *structInfo, keys []string, rows []map[string]interface{}) ([]interface{}, error) {
+	var args []interface{}
+	cols := make([]string, len(keys))
+	for i, k := range keys {
+		cols[i] = d.quote(k)
+	}
+	values := make([]string, len(rows))
+	for i, row := range rows {
+		params := make([]string, len(keys))
+		for j, k := range keys {
+			v, ok := row[k]
+			if !ok {
+				params[j] = "DEFAULT"
+				continue
+			}
+			args = append(args, v)
+			params[j] = d.placeholder(len(args))
+		}
+		values[i] = "(" + strings.Join(params, ", ") + ")"
+	}
+	query := "INSERT INTO " + d.quote(table) + " (" + strings.Join(cols, ", ") + ") VALUES " + strings.Join(values, ", ")
+
+	ids := make([]interface{}, len(rows))
+	fi := sinfo.PKFieldInfo
+	if fi == nil {
+		_, err := d.conn.Exec(query, args...)
+		return ids, err
+	}
+	res, err := d.conn.Query(query+" RETURNING "+d.quote(fi.Key), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+	// rows are returned in the order of VALUES
+	for i := 0; res.Next(); i++ {
+		if i < len(ids) {
+			err = res.Scan(&ids[i])
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return ids, res.Err()
+}
+
+// batchSize keeps the number of bind parameters of a batch under
+// postgresql's limit of 65535.
+func (d *sqlDriver) batchSize(fields int) int {
+	if fields < 1 {
+		fields = 1
+	}
+	if n := 65535 / fields; n < 1000 {
+		return n
+	}
+	return 1000
+}
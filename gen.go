@@ -0,0 +1,155 @@
+package bondb
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"time"
+
+	"upper.io/db"
+)
+
+// SequenceCollection is the collection holding the counters of
+// GenerateSequence, one record per collection.
+var SequenceCollection = "counters"
+
+// Generator returns a new primary key for an item of the collection. It is
+// used by fields tagged with gen=<name>, ie. `bondb:",pk,gen=uuid"`.
+type Generator func(s *Session, collection string) (interface{}, error)
+
+// builtinGenerators are the generators available without registration.
+var builtinGenerators = map[string]Generator{
+	"uuid": GenerateUUID,
+	"ulid": GenerateULID,
+	"seq":  GenerateSequence,
+}
+
+// RegisterGenerator makes gen available to fields tagged with gen=name,
+// replacing a built-in generator of the same name.
+func (s *Session) RegisterGenerator(name string, gen Generator) {
+	s.cache.Lock()
+	s.cache.generators[name] = gen
+	s.cache.Unlock()
+}
+
+func (s *Session) generator(name string) Generator {
+	s.cache.Lock()
+	gen, ok := s.cache.generators[name]
+	s.cache.Unlock()
+	if ok {
+		return gen
+	}
+	return builtinGenerators[name]
+}
+
+// generateKey fills the zero primary key fields of a new item that have a
+// generator.
+func (s *Session) generateKey(itemv reflect.Value, col db.Collection) error {
+	v := indirectStruct(itemv)
+	if !v.IsValid() {
+		return nil
+	}
+	sinfo, err := getStructInfo(v.Type())
+	if err != nil {
+		return err
+	}
+	for _, fi := range sinfo.PKFieldsList {
+		if fi.Gen == "" {
+			continue
+		}
+		f := v.FieldByIndex(fi.Index)
+		if !isZero(f) {
+			continue
+		}
+		if !f.CanSet() {
+			return ErrUnsettablePK
+		}
+		gen := s.generator(fi.Gen)
+		if gen == nil {
+			return fmt.Errorf("bondb: unknown generator %q for %s.%s", fi.Gen, v.Type(), fi.Name)
+		}
+		oid, err := gen(s, col.Name())
+		if err != nil {
+			return err
+		}
+		id, err := convertID(oid, f.Type())
+		if err != nil {
+			return err
+		}
+		f.Set(id)
+	}
+	return nil
+}
+
+// GenerateUUID returns a random (version 4) UUID string.
+func GenerateUUID(s *Session, collection string) (interface{}, error) {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		return nil, err
+	}
+	u[6] = u[6]&0x0f | 0x40 // version 4
+	u[8] = u[8]&0x3f | 0x80 // RFC 4122 variant
+
+	var buf [36]byte
+	hex.Encode(buf[0:8], u[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], u[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], u[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], u[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], u[10:])
+	return string(buf[:]), nil
+}
+
+// crockford is the base32 alphabet of ULIDs.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// GenerateULID returns a ULID string: a millisecond timestamp taken from
+// the session's clock followed by 80 random bits, so keys sort by creation
+// time.
+func GenerateULID(s *Session, collection string) (interface{}, error) {
+	var u [16]byte
+	ms := uint64(s.Now().UnixNano() / int64(time.Millisecond))
+	for i := 5; i >= 0; i-- {
+		u[i] = byte(ms)
+		ms >>= 8
+	}
+	if _, err := rand.Read(u[6:]); err != nil {
+		return nil, err
+	}
+
+	// 128 bits encode to 26 characters, 5 bits at a time starting with the
+	// 3 most significant bits
+	var buf [26]byte
+	var acc uint32
+	bits := uint(2) // pad the 128 bits to 130
+	j := 0
+	for _, b := range u {
+		acc = acc<<8 | uint32(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			buf[j] = crockford[acc>>bits&31]
+			j++
+		}
+	}
+	return string(buf[:]), nil
+}
+
+// GenerateSequence returns the next value of a monotonic integer sequence
+// of the collection, stored in SequenceCollection. It is meant for mongo,
+// which has no auto increment, and returns db.ErrUnsupported for adapters
+// bondb doesn't have a driver for.
+func GenerateSequence(s *Session, collection string) (interface{}, error) {
+	if err := s.ctxErr(); err != nil {
+		return nil, err
+	}
+	d, err := s.driver()
+	if err != nil {
+		return nil, err
+	}
+	return d.nextSeq(SequenceCollection, collection)
+}
@@ -0,0 +1,94 @@
+package bondb
+
+import (
+	"reflect"
+
+	"upper.io/db"
+)
+
+// Iter streams the records matching a query one at a time, see query.Iter.
+type Iter struct {
+	q      *query
+	err    error
+	closed bool
+}
+
+// Iter returns an iterator over the records matching the query, which
+// decodes them one at a time rather than loading them all as All does:
+//
+//	iter := session.Query(&User{}).Where(cond).Iter()
+//	defer iter.Close()
+//	var user User
+//	for iter.Next(&user) {
+//		...
+//	}
+//	if err := iter.Err(); err != nil {
+//		...
+//	}
+//
+// The iterator has its own cursor, see Clone. The cursor is closed once
+// Next returns false. Close it when stopping early.
+func (q *query) Iter() *Iter {
+	return &Iter{q: q.Clone(), err: q.err}
+}
+
+// Next decodes the next record into dst, a pointer to a struct, and runs
+// AfterFind on it. It returns false when there are no more records or on
+// an error, see Err.
+func (it *Iter) Next(dst interface{}) bool {
+	if it.err != nil || it.closed {
+		return false
+	}
+	err := it.q.Next(dst)
+	if err == db.ErrNoMoreRows {
+		it.Close()
+		return false
+	}
+	if err != nil {
+		it.err = err
+		it.Close()
+		return false
+	}
+	return true
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *Iter) Err() error {
+	return it.err
+}
+
+// Close closes the cursor. It may be called more than once.
+func (it *Iter) Close() error {
+	if it.closed || it.q.Result == nil {
+		return nil
+	}
+	it.closed = true
+	err := it.q.Result.Close()
+	if it.err == nil {
+		it.err = err
+	}
+	return err
+}
+
+// Each calls fn with each record matching the query, as a new pointer to
+// the struct type of dst, after AfterFind has run on it. It stops at the
+// first error, either of the query or returned by fn, and returns it.
+func (q *query) Each(fn func(item interface{}) error) error {
+	if q.err != nil {
+		return q.err
+	}
+	if q.sinfo == nil {
+		return db.ErrExpectingPointer
+	}
+	it := q.Iter()
+	defer it.Close()
+	for {
+		item := reflect.New(q.sinfo.Zero.Type()).Interface()
+		if !it.Next(item) {
+			return it.Err()
+		}
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package bondb
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// ModifyOptions are the options of query.FindAndModify.
+type ModifyOptions struct {
+	ReturnNew bool // return the record as updated rather than as it was
+	Upsert    bool // insert a record from the query conditions if none matches
+}
+
+// FindAndModify atomically updates the first record matching the query, in
+// the order given to Sort, and decodes it into dst. update sets fields by
+// db key or Go field name, and is applied along with the operations added
+// with Inc, Push, Pull, AddToSet, Unset and SetOnInsert, see Apply. The
+// query conditions must be equality conditions.
+//
+// dst gets the record as it was before the update, or after it with
+// opts.ReturnNew, and AfterFind runs on it. db.ErrNoMoreRows is returned
+// if no record matches and opts.Upsert is false. When a record is inserted
+// and opts.ReturnNew is false, dst is left as is.
+//
+// Mongo runs a native findAndModify. Postgresql locks the record in a
+// transaction and updates it with RETURNING. Other adapters return an
+// *UnsupportedOpError.
+func (q *query) FindAndModify(update map[string]interface{}, opts ModifyOptions) error {
+	if q.err != nil {
+		return q.err
+	}
+	if err := q.session.ctxErr(); err != nil {
+		return err
+	}
+	if q.dstv.Elem().Kind() == reflect.Slice {
+		return errors.New("bondb: FindAndModify expects a pointer to a struct")
+	}
+	cond, ok := q.equalityCond()
+	if !ok {
+		return errors.New("bondb: FindAndModify requires equality conditions")
+	}
+	sort := make([]string, len(q.sort))
+	for i, key := range q.sort {
+		s, ok := key.(string)
+		if !ok {
+			return fmt.Errorf("bondb: FindAndModify can't sort by %v", key)
+		}
+		sort[i] = s
+	}
+
+	ops := make([]fieldOp, 0, len(update)+len(q.ops))
+	for _, name := range sortedKeys(update) {
+		key := name
+		if q.sinfo != nil {
+			var err error
+			key, err = q.sinfo.key(name)
+			if err != nil {
+				return err
+			}
+		}
+		ops = append(ops, fieldOp{Op: opSet, Key: key, Value: update[name]})
+	}
+	ops = append(ops, q.ops...)
+	if err := checkOps(ops); err != nil {
+		return err
+	}
+	ops = q.touchOps(ops)
+	if len(ops) == 0 {
+		return errors.New("bondb: no operations to apply")
+	}
+
+	drv, err := q.session.driver()
+	if err != nil {
+		return err
+	}
+	tmp := reflect.New(q.dstv.Elem().Type())
+	if e := tmp.Elem(); e.Kind() == reflect.Ptr {
+		e.Set(reflect.New(e.Type().Elem()))
+	}
+	found, err := drv.findAndModify(q.Collection.Name(), cond, sort, ops, opts, tmp.Interface())
+	if err != nil || !found {
+		return err
+	}
+	q.dstv.Elem().Set(tmp.Elem())
+	afterFind(q.session.Context(), q.dstv)
+	return nil
+}
@@ -0,0 +1,47 @@
+package bondb
+
+import (
+	"reflect"
+	"strings"
+	"unicode"
+)
+
+// PluralSnakeCase names a collection after the pluralised, snake_cased name
+// of a struct type, ie. AccountResource becomes "account_resources". It is
+// meant to be used as a Session.CollectionNamer.
+func PluralSnakeCase(t reflect.Type) string {
+	return pluralize(snakeCase(t.Name()))
+}
+
+// snakeCase converts a Go name to snake_case, keeping initialisms together,
+// ie. HTTPRequest becomes "http_request".
+func snakeCase(name string) string {
+	runes := []rune(name)
+	var b []rune
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			if i > 0 && (unicode.IsLower(runes[i-1]) ||
+				(i+1 < len(runes) && unicode.IsLower(runes[i+1]) && unicode.IsUpper(runes[i-1]))) {
+				b = append(b, '_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b = append(b, r)
+	}
+	return string(b)
+}
+
+// pluralize returns the plural of an english noun using the common suffix
+// rules. It doesn't know about irregular nouns.
+func pluralize(s string) string {
+	switch {
+	case s == "":
+		return s
+	case strings.HasSuffix(s, "s"), strings.HasSuffix(s, "x"), strings.HasSuffix(s, "z"),
+		strings.HasSuffix(s, "ch"), strings.HasSuffix(s, "sh"):
+		return s + "es"
+	case strings.HasSuffix(s, "y") && len(s) > 1 && !strings.ContainsRune("aeiou", rune(s[len(s)-2])):
+		return s[:len(s)-1] + "ies"
+	}
+	return s + "s"
+}
@@ -0,0 +1,284 @@
+package bondb
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"upper.io/db"
+)
+
+// Field operators applied by query.Apply.
+const (
+	opSet         = "set"
+	opInc         = "inc"
+	opPush        = "push"
+	opPull        = "pull"
+	opAddToSet    = "addToSet"
+	opUnset       = "unset"
+	opSetOnInsert = "setOnInsert"
+)
+
+// fieldOp is an atomic operation on the field with the db key Key.
+type fieldOp struct {
+	Op    string
+	Key   string
+	Value interface{}
+}
+
+// UnsupportedOpError is returned by query.Apply for an operation the
+// database adapter can't express.
+type UnsupportedOpError struct {
+	Op      string
+	Adapter string
+}
+
+func (e *UnsupportedOpError) Error() string {
+	return fmt.Sprintf("bondb: %s is not supported by the %s adapter", e.Op, e.Adapter)
+}
+
+// Inc adds n to the field, see Apply.
+func (q *query) Inc(field string, n interface{}) *query {
+	return q.op(opInc, field, n)
+}
+
+// Push appends v to the array field, see Apply.
+func (q *query) Push(field string, v interface{}) *query {
+	return q.op(opPush, field, v)
+}
+
+// Pull removes all occurrences of v from the array field, see Apply.
+func (q *query) Pull(field string, v interface{}) *query {
+	return q.op(opPull, field, v)
+}
+
+// AddToSet appends v to the array field unless it already holds it, see
+// Apply.
+func (q *query) AddToSet(field string, v interface{}) *query {
+	return q.op(opAddToSet, field, v)
+}
+
+// Unset clears the fields, see Apply.
+func (q *query) Unset(fields ...string) *query {
+	for _, field := range fields {
+		q = q.op(opUnset, field, "")
+	}
+	return q
+}
+
+// SetOnInsert sets the field to v when Apply inserts a new record, see
+// Apply.
+func (q *query) SetOnInsert(field string, v interface{}) *query {
+	return q.op(opSetOnInsert, field, v)
+}
+
+func (q *query) op(op, field string, v interface{}) *query {
+	if q.err != nil {
+		return q
+	}
+	c := q.clone()
+	key := field
+	if q.sinfo != nil {
+		key, c.err = q.sinfo.key(field)
+		if c.err != nil {
+			return c
+		}
+	}
+	c.ops = append(c.ops, fieldOp{Op: op, Key: key, Value: v})
+	c.err = checkOps(c.ops)
+	return c.build()
+}
+
+// checkOps returns an error if two of ops apply to the same field, which
+// mongo rejects as a conflict and SQL as a column set twice.
+func checkOps(ops []fieldOp) error {
+	seen := make(map[string]string, len(ops))
+	for _, o := range ops {
+		if op, ok := seen[o.Key]; ok {
+			return fmt.Errorf("bondb: %s and %s both apply to %s, use separate updates", op, o.Op, o.Key)
+		}
+		seen[o.Key] = o.Op
+	}
+	return nil
+}
+
+// Apply runs the operations added with Inc, Push, Pull, AddToSet, Unset
+// and SetOnInsert on the records matching the query, as a single atomic
+// update of each record, and returns the number of records matched. The
+// updated field of the records is set to the current time and their
+// version field is incremented, unless an operation applies to them. Each
+// field takes a single operation, an error is returned for a field given
+// two.
+//
+// With SetOnInsert, a record is inserted from the query conditions when
+// none matches, which requires equality conditions.
+//
+// Mongo supports all operations. SQL adapters support Inc and Unset, and
+// postgresql also Push, Pull and AddToSet on array columns. Operations an
+// adapter can't express return an *UnsupportedOpError.
+func (q *query) Apply() (int, error) {
+	if q.err != nil {
+		return 0, q.err
+	}
+	if err := q.session.ctxErr(); err != nil {
+		return 0, err
+	}
+	if len(q.ops) == 0 {
+		return 0, errors.New("bondb: no operations to apply")
+	}
+	drv, err := q.session.driver()
+	if err != nil {
+		return 0, err
+	}
+	ops := q.touchOps(q.ops)
+	var conds []db.Cond
+	if hasOp(ops, opSetOnInsert) {
+		cond, ok := q.equalityCond()
+		if !ok {
+			return 0, errors.New("bondb: SetOnInsert requires equality conditions")
+		}
+		conds = []db.Cond{cond}
+	} else {
+		conds, err = q.driverConds(drv)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return eachCond(conds, func(cond db.Cond) (int, error) {
+		return drv.apply(q.Collection.Name(), cond, ops)
+	})
+}
+
+// touchOps returns ops along with setting the updated field to the current
+// time and incrementing the version field, unless ops apply to them.
+func (q *query) touchOps(ops []fieldOp) []fieldOp {
+	if q.sinfo == nil {
+		return ops
+	}
+	ops = ops[:len(ops):len(ops)]
+	if fi := q.sinfo.UpdatedFieldInfo; fi != nil && !hasKey(ops, fi.Key) {
+		now := q.session.Now()
+		if fi.UTC {
+			now = now.UTC()
+		}
+		ops = append(ops, fieldOp{Op: opSet, Key: fi.Key, Value: now})
+	}
+	if fi := q.sinfo.VersionFieldInfo; fi != nil && !hasKey(ops, fi.Key) {
+		ops = append(ops, fieldOp{Op: opInc, Key: fi.Key, Value: 1})
+	}
+	return ops
+}
+
+func hasOp(ops []fieldOp, op string) bool {
+	for _, o := range ops {
+		if o.Op == op {
+			return true
+		}
+	}
+	return false
+}
+
+func hasKey(ops []fieldOp, key string) bool {
+	for _, o := range ops {
+		if o.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// equalityCond returns the query conditions as a single equality condition,
+// or false if they have operators or db.And and db.Or.
+func (q *query) equalityCond() (db.Cond, bool) {
+	cond := db.Cond{}
+	for _, c := range q.where() {
+		c, ok := c.(db.Cond)
+		if !ok {
+			return nil, false
+		}
+		for k, v := range c {
+			if strings.ContainsAny(k, " $") {
+				return nil, false
+			}
+			cond[k] = v
+		}
+	}
+	return cond, true
+}
+
+// plainCond returns the query conditions as a single driver condition, or
+// false if they have db.And, db.Or or operators a driver can't express.
+func (q *query) plainCond() (db.Cond, bool) {
+	cond := db.Cond{}
+	for _, c := range q.where() {
+		c, ok := c.(db.Cond)
+		if !ok {
+			return nil, false
+		}
+		for k, v := range c {
+			if !isPlainCond(k, v) {
+				return nil, false
+			}
+			field, op, _ := condKey(k)
+			if op != "=" {
+				field += " " + op
+			}
+			if prev, ok := cond[field]; ok && !reflect.DeepEqual(prev, v) {
+				return nil, false
+			}
+			cond[field] = v
+		}
+	}
+	return cond, true
+}
+
+// driverConds returns the query conditions as driver conditions, see
+// driver. Conditions a driver can't express, ie. db.Or, are resolved to the
+// primary keys of the matching records, split in lists of drv.batchSize(1)
+// keys, so writes on them aren't atomic.
+func (q *query) driverConds(drv driver) ([]db.Cond, error) {
+	if cond, ok := q.plainCond(); ok {
+		return []db.Cond{cond}, nil
+	}
+	if q.sinfo == nil || q.sinfo.PKFieldInfo == nil {
+		return nil, errors.New("bondb: conditions with db.And, db.Or or raw values require a single field primary key")
+	}
+
+	key := q.sinfo.PKFieldInfo.Key
+	var rows []map[string]interface{}
+	err := q.session.wait(func() error {
+		return q.Collection.Find(q.where()...).Select(key).All(&rows)
+	})
+	if err != nil {
+		return nil, err
+	}
+	size := drv.batchSize(1)
+	var conds []db.Cond
+	for start := 0; start < len(rows); start += size {
+		batch := rows[start:]
+		if len(batch) > size {
+			batch = batch[:size]
+		}
+		ids := make([]interface{}, len(batch))
+		for i, row := range batch {
+			ids[i] = row[key]
+		}
+		conds = append(conds, db.Cond{key: ids})
+	}
+	return conds, nil
+}
+
+// eachCond runs fn on each of conds, and returns the sum of the counts it
+// returns.
+func eachCond(conds []db.Cond, fn func(cond db.Cond) (int, error)) (int, error) {
+	total := 0
+	for _, cond := range conds {
+		n, err := fn(cond)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,260 @@
+package bondb
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"upper.io/db"
+)
+
+// ErrInvalidPageToken is returned by query.Page for a token that is
+// malformed, wrongly signed or was made for a different sort order.
+var ErrInvalidPageToken = errors.New("bondb: invalid page token")
+
+// pageToken is the payload of a page token, the sort keys of a query and
+// their values in the last record of a page.
+type pageToken struct {
+	Keys   []string          `json:"k"`
+	Values []json.RawMessage `json:"v"`
+}
+
+// After continues the query from a token returned by Page. An empty token
+// starts from the first page.
+func (q *query) After(token string) *query {
+	if q.err != nil {
+		return q
+	}
+	c := q.clone()
+	c.after = token
+	return c.build()
+}
+
+// Page fetches up to size records into dst, a pointer to a slice, and
+// returns the token of the next page, or "" after the last page. Pass the
+// token to After to get the next page:
+//
+//	token, err := session.Query(&users).Sort("-CreatedAt").After(token).Page(50)
+//
+// Pages are read by the values of their sort fields rather than by Skip,
+// so they don't shift when records are inserted or deleted meanwhile and
+// each page is as fast as the first. The primary key is added to the sort
+// fields to break ties. Sort fields must be fields of the struct, and
+// shouldn't be nullable.
+//
+// Tokens hold the sort values of the last record, and are signed with
+// HMAC-SHA256 when the session has a PageTokenKey.
+func (q *query) Page(size uint) (string, error) {
+	if q.err != nil {
+		return "", q.err
+	}
+	if err := q.session.ctxErr(); err != nil {
+		return "", err
+	}
+	if q.dstv.Elem().Kind() != reflect.Slice {
+		return "", db.ErrExpectingSlicePointer
+	}
+	if size == 0 {
+		return "", errors.New("bondb: page size must be positive")
+	}
+	fields, keys, err := q.pageKeys()
+	if err != nil {
+		return "", err
+	}
+
+	c := q.clone()
+	if q.after != "" {
+		values, err := q.decodePageToken(q.after, fields, keys)
+		if err != nil {
+			return "", err
+		}
+		c.conds = append(c.conds, keysetCond(keys, values))
+	}
+	c.sort = make([]interface{}, len(keys))
+	for i, key := range keys {
+		c.sort[i] = key
+	}
+	c.limit = size + 1
+	c.build()
+	err = c.fetch(c.Result.All)
+	if err != nil {
+		return "", err
+	}
+
+	items := q.dstv.Elem()
+	more := uint(items.Len()) > size
+	if more {
+		items.Set(items.Slice(0, int(size)))
+	}
+	ctx := q.session.Context()
+	for i := 0; i < items.Len(); i++ {
+		afterFind(ctx, items.Index(i))
+	}
+	if !more {
+		return "", nil
+	}
+	return q.encodePageToken(fields, keys, indirectStruct(items.Index(items.Len()-1)))
+}
+
+// pageKeys returns the sort keys of a page, which are those given to Sort
+// followed by the primary key fields that are missing, and their fields.
+func (q *query) pageKeys() ([]*fieldInfo, []string, error) {
+	if q.sinfo == nil {
+		return nil, nil, db.ErrExpectingSlicePointer
+	}
+	var fields []*fieldInfo
+	var keys []string
+	seen := make(map[string]bool)
+	for _, v := range q.sort {
+		key, ok := v.(string)
+		fi := q.sinfo.field(strings.TrimPrefix(key, "-"))
+		if !ok || fi == nil {
+			return nil, nil, fmt.Errorf("bondb: can't page by %v", v)
+		}
+		fields = append(fields, fi)
+		keys = append(keys, key)
+		seen[fi.Key] = true
+	}
+	if len(q.sinfo.PKFieldsList) == 0 {
+		return nil, nil, ErrNoPrimaryKey
+	}
+	for _, fi := range q.sinfo.PKFieldsList {
+		if !seen[fi.Key] {
+			fields = append(fields, fi)
+			keys = append(keys, fi.Key)
+		}
+	}
+	return fields, keys, nil
+}
+
+// keysetCond returns the condition matching the records that sort after
+// the given values of the sort keys, ie. for keys a and -b:
+// a > va OR (a = va AND b < vb).
+func keysetCond(keys []string, values []interface{}) db.Or {
+	or := make(db.Or, len(keys))
+	for i, key := range keys {
+		cond := db.Cond{}
+		for j := 0; j < i; j++ {
+			cond[strings.TrimPrefix(keys[j], "-")] = values[j]
+		}
+		if strings.HasPrefix(key, "-") {
+			cond[key[1:]+" <"] = values[i]
+		} else {
+			cond[key+" >"] = values[i]
+		}
+		or[i] = cond
+	}
+	return or
+}
+
+func (q *query) encodePageToken(fields []*fieldInfo, keys []string, last reflect.Value) (string, error) {
+	t := pageToken{Keys: keys, Values: make([]json.RawMessage, len(fields))}
+	for i, fi := range fields {
+		b, err := json.Marshal(last.FieldByIndex(fi.Index).Interface())
+		if err != nil {
+			return "", err
+		}
+		t.Values[i] = b
+	}
+	payload, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(payload)
+	if key := q.session.PageTokenKey; len(key) > 0 {
+		token += "." + base64.RawURLEncoding.EncodeToString(signPageToken(key, token))
+	}
+	return token, nil
+}
+
+// decodePageToken returns the values of the sort keys held by token,
+// decoded to the types of their fields.
+func (q *query) decodePageToken(token string, fields []*fieldInfo, keys []string) ([]interface{}, error) {
+	if key := q.session.PageTokenKey; len(key) > 0 {
+		i := strings.LastIndex(token, ".")
+		if i < 0 {
+			return nil, ErrInvalidPageToken
+		}
+		sig, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+		if err != nil || !hmac.Equal(sig, signPageToken(key, token[:i])) {
+			return nil, ErrInvalidPageToken
+		}
+		token = token[:i]
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidPageToken
+	}
+	var t pageToken
+	if err := json.Unmarshal(payload, &t); err != nil || len(t.Keys) != len(keys) || len(t.Values) != len(keys) {
+		return nil, ErrInvalidPageToken
+	}
+	values := make([]interface{}, len(fields))
+	for i, fi := range fields {
+		if t.Keys[i] != keys[i] {
+			return nil, ErrInvalidPageToken
+		}
+		v := reflect.New(fi.Zero.Type())
+		if err := json.Unmarshal(t.Values[i], v.Interface()); err != nil {
+			return nil, ErrInvalidPageToken
+		}
+		values[i] = v.Elem().Interface()
+	}
+	return values, nil
+}
+
+func signPageToken(key []byte, token string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(token))
+	return mac.Sum(nil)
+}
+
+// PageInfo describes a page returned by query.Paginate.
+type PageInfo struct {
+	Page    uint   // 1-based
+	PerPage uint   // records per page
+	Total   uint64 // records matching the query
+	Pages   uint   // number of pages
+	HasNext bool
+	HasPrev bool
+}
+
+// Paginate fetches page number page, starting at 1, of perPage records into
+// dst, a pointer to a slice, and returns it along with the total count of
+// records matching the query. Limit and Skip are replaced, and the count
+// ignores them.
+//
+// The count and the fetch are separate queries, see Page for pagination
+// that is stable while records are inserted.
+func (q *query) Paginate(page, perPage uint) (PageInfo, error) {
+	if q.err != nil {
+		return PageInfo{}, q.err
+	}
+	if page == 0 || perPage == 0 {
+		return PageInfo{}, errors.New("bondb: page and perPage must be positive")
+	}
+	if q.dstv.Elem().Kind() != reflect.Slice {
+		return PageInfo{}, db.ErrExpectingSlicePointer
+	}
+	total, err := q.countAll()
+	if err != nil {
+		return PageInfo{}, err
+	}
+	if err := q.Skip((page - 1) * perPage).Limit(perPage).All(); err != nil {
+		return PageInfo{}, err
+	}
+	pages := (uint(total) + perPage - 1) / perPage
+	return PageInfo{
+		Page:    page,
+		PerPage: perPage,
+		Total:   uint64(total),
+		Pages:   pages,
+		HasNext: page < pages,
+		HasPrev: page > 1,
+	}, nil
+}
@@ -0,0 +1,191 @@
+package bondb
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+
+	"upper.io/db"
+)
+
+// setPrimaryKey assigns oid, the primary key returned by the database for a
+// new item, to the item. Items implementing db.IDSetter, db.Int64IDSetter
+// or db.Uint64IDSetter set it themselves, otherwise oid is converted to the
+// type of the pk field.
+func (s *Session) setPrimaryKey(itemv reflect.Value, oid interface{}) error {
+	if itemv.Kind() != reflect.Ptr {
+		return nil // skip, we need a pointer
+	}
+	v := indirectStruct(itemv)
+	if !v.IsValid() {
+		return nil
+	}
+	sinfo, err := getStructInfo(v.Type())
+	if err != nil {
+		return err
+	}
+	fi := sinfo.PKFieldInfo
+	if fi == nil {
+		return nil
+	}
+
+	switch item := v.Addr().Interface().(type) {
+	case db.IDSetter:
+		return item.SetID(map[string]interface{}{fi.Key: oid})
+	case db.Int64IDSetter:
+		id, err := convertID(oid, reflect.TypeOf(int64(0)))
+		if err != nil {
+			return err
+		}
+		return item.SetID(id.Int())
+	case db.Uint64IDSetter:
+		id, err := convertID(oid, reflect.TypeOf(uint64(0)))
+		if err != nil {
+			return err
+		}
+		return item.SetID(id.Uint())
+	}
+
+	f := v.FieldByIndex(fi.Index)
+	if !f.CanSet() {
+		return ErrUnsettablePK
+	}
+	id, err := convertID(oid, f.Type())
+	if err != nil {
+		return err
+	}
+	f.Set(id)
+	return nil
+}
+
+// convertID converts an id returned by a database adapter, ie. an int64
+// from a SQL adapter or a bson.ObjectId from mongo, to a value of type t.
+// Numbers are converted between widths as long as they don't overflow, and
+// to and from strings. Pointer types get a pointer to the converted value.
+func convertID(oid interface{}, t reflect.Type) (reflect.Value, error) {
+	v := reflect.ValueOf(oid)
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if !v.IsValid() || v.Kind() == reflect.Ptr {
+		return reflect.Value{}, ErrUnsettablePK
+	}
+
+	if t.Kind() == reflect.Ptr {
+		id, err := convertID(v.Interface(), t.Elem())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		p := reflect.New(t.Elem())
+		p.Elem().Set(id)
+		return p, nil
+	}
+	if v.Type().AssignableTo(t) {
+		return v, nil
+	}
+
+	id := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := toInt64(v)
+		if !ok || id.OverflowInt(n) {
+			return reflect.Value{}, ErrUnsettablePK
+		}
+		id.SetInt(n)
+		return id, nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, ok := toInt64(v)
+		if ok && n < 0 {
+			return reflect.Value{}, ErrUnsettablePK
+		}
+		u := uint64(n)
+		if !ok {
+			if v.Kind() < reflect.Uint || v.Kind() > reflect.Uint64 {
+				return reflect.Value{}, ErrUnsettablePK
+			}
+			u = v.Uint() // too large for an int64
+		}
+		if id.OverflowUint(u) {
+			return reflect.Value{}, ErrUnsettablePK
+		}
+		id.SetUint(u)
+		return id, nil
+
+	case reflect.String:
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			id.SetString(strconv.FormatInt(v.Int(), 10))
+			return id, nil
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			id.SetString(strconv.FormatUint(v.Uint(), 10))
+			return id, nil
+		}
+	}
+
+	if v.Type().ConvertibleTo(t) && v.Kind() == t.Kind() {
+		return v.Convert(t), nil
+	}
+	if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 && t.Kind() == reflect.String {
+		return v.Convert(t), nil // []byte
+	}
+	return reflect.Value{}, ErrUnsettablePK
+}
+
+// toInt64 returns the value of an integer, or a string holding one, as an
+// int64.
+func toInt64(v reflect.Value) (int64, bool) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u := v.Uint()
+		if u > 1<<63-1 {
+			return 0, false
+		}
+		return int64(u), true
+	case reflect.String:
+		n, err := strconv.ParseInt(v.String(), 10, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// pkCond returns the condition matching the primary key id. A single field
+// key takes its value as is, unless it is a struct that isn't of the field's
+// type. Composite keys take a []interface{} of the values of their fields in
+// order, or a struct with fields named as theirs.
+func (si *structInfo) pkCond(id interface{}) (db.Cond, error) {
+	pks := si.PKFieldsList
+	if len(pks) == 0 {
+		return nil, ErrNoPrimaryKey
+	}
+	cond := make(db.Cond, len(pks))
+
+	if values, ok := id.([]interface{}); ok && len(pks) > 1 {
+		if len(values) != len(pks) {
+			return nil, fmt.Errorf("expecting %d primary key values for %s, got %d", len(pks), si.Zero.Type(), len(values))
+		}
+		for i, fi := range pks {
+			cond[fi.Key] = values[i]
+		}
+		return cond, nil
+	}
+
+	v := reflect.Indirect(reflect.ValueOf(id))
+	if v.Kind() != reflect.Struct || (len(pks) == 1 && v.Type().AssignableTo(pks[0].Zero.Type())) {
+		if len(pks) > 1 {
+			return nil, fmt.Errorf("expecting %d primary key values for %s, got %T", len(pks), si.Zero.Type(), id)
+		}
+		cond[pks[0].Key] = id
+		return cond, nil
+	}
+	for _, fi := range pks {
+		f := v.FieldByName(fi.Name)
+		if !f.IsValid() {
+			return nil, fmt.Errorf("%s has no primary key field %s", v.Type(), fi.Name)
+		}
+		cond[fi.Key] = f.Interface()
+	}
+	return cond, nil
+}
@@ -1,7 +1,10 @@
 package bondb
 
 import (
+	"context"
+	"fmt"
 	"reflect"
+	"strings"
 	"time"
 
 	"upper.io/db"
@@ -11,8 +14,20 @@ type query struct {
 	session *Session
 	dst     interface{}
 	dstv    reflect.Value
+	sinfo   *structInfo // of the struct type behind dst, if any
 	err     error
 
+	conds       []interface{}
+	withDeleted bool
+	limit       uint
+	skip        uint
+	sort        []interface{} // db keys, as given to Sort
+	fields      []interface{} // db keys, as given to Select
+	group       []interface{}
+	ops         []fieldOp // applied by Apply
+	after       string    // page token, see Page
+	strict      bool      // see Strict
+
 	Collection db.Collection
 	Result     db.Result
 }
@@ -21,7 +36,7 @@ func NewQuery(session *Session, dst interface{}) *query {
 	q := &query{session: session, dst: dst}
 
 	dstv := reflect.ValueOf(dst)
-	if dstv.IsNil() || dstv.Kind() != reflect.Ptr {
+	if dstv.Kind() != reflect.Ptr || dstv.IsNil() {
 		q.err = db.ErrExpectingPointer
 		return q
 	}
@@ -32,90 +47,324 @@ func NewQuery(session *Session, dst interface{}) *query {
 		q.err = err
 		return q
 	}
+	if st := structType(dstv.Type()); st != nil {
+		q.sinfo, err = getStructInfo(st)
+		if err != nil {
+			q.err = err
+			return q
+		}
+	}
 	q.Collection = col
-	q.Result = q.Collection.Find(db.Cond{})
-	return q
+	return q.build()
+}
+
+// where returns the query conditions, excluding soft deleted records
+// unless WithDeleted was called.
+func (q *query) where() []interface{} {
+	conds := q.conds
+	if q.sinfo != nil && q.sinfo.DeletedFieldInfo != nil && !q.withDeleted {
+		conds = append(conds[:len(conds):len(conds)], notDeleted(q.sinfo.DeletedFieldInfo))
+	}
+	if len(conds) == 0 {
+		return []interface{}{db.Cond{}}
+	}
+	return conds
+}
+
+// notDeleted returns the condition matching records that aren't soft
+// deleted by the field.
+func notDeleted(fi *fieldInfo) db.Cond {
+	if fi.Zero.Kind() == reflect.Ptr {
+		return db.Cond{fi.Key: nil}
+	}
+	return db.Cond{fi.Key: time.Time{}}
+}
+
+// WithDeleted includes soft deleted records in the query results.
+func (q *query) WithDeleted() *query {
+	if q.err != nil {
+		return q
+	}
+	c := q.clone()
+	c.withDeleted = true
+	return c.build()
 }
 
 func (q *query) Limit(v uint) *query {
-	q.Result = q.Result.Limit(v)
-	return q
+	if q.err != nil {
+		return q
+	}
+	c := q.clone()
+	c.limit = v
+	return c.build()
 }
 
 func (q *query) Skip(v uint) *query {
-	q.Result = q.Result.Skip(v)
-	return q
+	if q.err != nil {
+		return q
+	}
+	c := q.clone()
+	c.skip = v
+	return c.build()
 }
 
+// Sort orders the results by the given fields, which may be db keys or Go
+// field names, prefixed with "-" for descending order.
 func (q *query) Sort(v ...interface{}) *query {
-	q.Result = q.Result.Sort(v...)
-	return q
+	if q.err != nil {
+		return q
+	}
+	c := q.clone()
+	c.sort, c.err = q.keys(v, true)
+	return c.build()
 }
 
+// Select limits the returned fields to the given db keys or Go field names.
 func (q *query) Select(v ...interface{}) *query {
-	q.Result = q.Result.Select(v...)
-	return q
+	if q.err != nil {
+		return q
+	}
+	c := q.clone()
+	c.fields, c.err = q.keys(v, false)
+	return c.build()
 }
 
+// Where sets the conditions of the query. Condition keys may be db keys or
+// Go field names.
 func (q *query) Where(v ...interface{}) *query {
-	q.Result = q.Result.Where(v...)
-	return q
+	if q.err != nil {
+		return q
+	}
+	c := q.clone()
+	c.conds, c.err = q.translateConds(v)
+	return c.build()
 }
 
 func (q *query) Group(v ...interface{}) *query {
-	q.Result = q.Result.Group(v...)
+	if q.err != nil {
+		return q
+	}
+	c := q.clone()
+	c.group = v
+	return c.build()
+}
+
+// Clone returns a copy of the query with its own Result. The builder
+// methods, ie. Where, Sort and Limit, already return a new query and leave
+// q as is, so that a partially built query can be reused as the base of
+// others. Clone is needed to read a query with Next from several places,
+// as each Result has a single cursor.
+func (q *query) Clone() *query {
+	if q.err != nil {
+		return q
+	}
+	return q.clone().build()
+}
+
+// clone returns a copy of q that shares its Result. The slices of the copy
+// are capped, so that appending to them doesn't write to those of q.
+func (q *query) clone() *query {
+	c := *q
+	c.conds = q.conds[:len(q.conds):len(q.conds)]
+	c.ops = q.ops[:len(q.ops):len(q.ops)]
+	return &c
+}
+
+// build sets the Result of q from the query state, unless q has an error.
+func (q *query) build() *query {
+	if q.err != nil {
+		return q
+	}
+	r := q.Collection.Find(q.where()...)
+	if q.limit > 0 {
+		r = r.Limit(q.limit)
+	}
+	if q.skip > 0 {
+		r = r.Skip(q.skip)
+	}
+	if len(q.sort) > 0 {
+		r = r.Sort(q.sort...)
+	}
+	if len(q.fields) > 0 {
+		r = r.Select(q.fields...)
+	}
+	if len(q.group) > 0 {
+		r = r.Group(q.group...)
+	}
+	q.Result = r
 	return q
 }
 
 func (q *query) Count() (uint64, error) {
-	return q.Result.Count()
+	if q.err != nil {
+		return 0, q.err
+	}
+	var n uint64
+	err := q.session.wait(func() (err error) {
+		n, err = q.Result.Count()
+		return
+	})
+	return n, err
 }
 
+// Next decodes the next record of the query results into v, a pointer to a
+// struct, and returns db.ErrNoMoreRows after the last one. See Iter for a
+// cursor that is closed when done.
 func (q *query) Next(v interface{}) error {
-	return q.Result.Next(v)
+	if q.err != nil {
+		return q.err
+	}
+	if err := q.session.ctxErr(); err != nil {
+		return err
+	}
+	dstv := reflect.ValueOf(v)
+	if dstv.Kind() != reflect.Ptr || dstv.IsNil() {
+		return db.ErrExpectingPointer
+	}
+	err := q.fetchInto(dstv, q.Result.Next)
+	if err != nil {
+		return err
+	}
+	afterFind(q.session.Context(), dstv)
+	return nil
 }
 
+// ID fetches the record with the primary key v. Composite keys are given
+// either as a []interface{} of values in the order of the key's fields, or
+// as a struct with fields of the same names, ie. the model itself.
 func (q *query) ID(v interface{}) error {
-	_, idkey, err := q.session.getPrimaryKey(q.dstv)
+	if q.err != nil {
+		return q.err
+	}
+	if q.sinfo == nil {
+		return fmt.Errorf("expecting a pointer to a struct, got %v", q.dstv.Type())
+	}
+	pk, err := q.sinfo.pkCond(v)
 	if err != nil {
 		return err
 	}
 
-	err = q.Result.Where(db.Cond{idkey: v}).One(q.dst)
+	q = q.Where(pk)
+	if q.err != nil {
+		return q.err
+	}
+	err = q.fetch(q.Result.One)
 	if err != nil {
 		return err
 	}
-	afterFind(q.dstv)
+	afterFind(q.session.Context(), q.dstv)
 	return nil
 }
 
+// Strict makes One return ErrMultipleRows when more than one record
+// matches the query, rather than the first of them.
+func (q *query) Strict() *query {
+	if q.err != nil {
+		return q
+	}
+	c := q.clone()
+	c.strict = true
+	return c.build()
+}
+
+// One fetches a record matching the query into dst. See Strict to check
+// that no other record matches.
 func (q *query) One() error {
 	if q.err != nil {
 		return q.err
 	}
-	err := q.Result.One(q.dst)
+	if q.strict {
+		return q.one()
+	}
+	err := q.fetch(q.Result.One)
 	if err != nil {
 		return err
 	}
-	afterFind(q.dstv)
+	afterFind(q.session.Context(), q.dstv)
 	return nil
 
 }
 
+// one fetches up to two records to check that a single one matches.
+func (q *query) one() error {
+	c := q.clone()
+	c.limit = 2
+	c.build()
+	items := reflect.New(reflect.SliceOf(q.dstv.Elem().Type()))
+	err := c.fetchInto(items, c.Result.All)
+	if err != nil {
+		return err
+	}
+	switch items.Elem().Len() {
+	case 0:
+		return db.ErrNoMoreRows
+	case 1:
+		q.dstv.Elem().Set(items.Elem().Index(0))
+		afterFind(q.session.Context(), q.dstv)
+		return nil
+	default:
+		return ErrMultipleRows
+	}
+}
+
+// First fetches the first record matching the query into dst, in the order
+// given to Sort or else by primary key.
 func (q *query) First() error {
 	if q.err != nil {
 		return q.err
 	}
-	err := q.Result.One(q.dst)
+	c := q.clone()
+	if len(c.sort) == 0 && q.sinfo != nil {
+		for _, fi := range q.sinfo.PKFieldsList {
+			c.sort = append(c.sort, fi.Key)
+		}
+	}
+	c.limit = 1
+	c.build()
+	err := c.fetch(c.Result.One)
 	if err != nil {
 		return err
 	}
-	afterFind(q.dstv)
+	afterFind(q.session.Context(), q.dstv)
 	return nil
-
 }
 
-// TODO: add Last() error method
+// Last fetches the last record matching the query into dst, in the order
+// given to Sort or else by primary key.
+func (q *query) Last() error {
+	if q.err != nil {
+		return q.err
+	}
+	c := q.clone()
+	c.sort = make([]interface{}, 0, len(q.sort))
+	for _, v := range q.sort {
+		key, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("bondb: Last can't reverse the sort by %v", v)
+		}
+		if strings.HasPrefix(key, "-") {
+			c.sort = append(c.sort, key[1:])
+		} else {
+			c.sort = append(c.sort, "-"+key)
+		}
+	}
+	if len(c.sort) == 0 {
+		if q.sinfo == nil || len(q.sinfo.PKFieldsList) == 0 {
+			return ErrNoPrimaryKey
+		}
+		for _, fi := range q.sinfo.PKFieldsList {
+			c.sort = append(c.sort, "-"+fi.Key)
+		}
+	}
+	c.limit = 1
+	c.build()
+	err := c.fetch(c.Result.One)
+	if err != nil {
+		return err
+	}
+	afterFind(q.session.Context(), q.dstv)
+	return nil
+}
 
 func (q *query) All() error {
 	if q.err != nil {
@@ -124,27 +373,92 @@ func (q *query) All() error {
 	if q.dstv.Elem().Kind() != reflect.Slice {
 		return db.ErrExpectingSlicePointer
 	}
-	err := q.Result.All(q.dst)
+	err := q.fetch(q.Result.All)
 	if err != nil {
 		return err
 	}
+	ctx := q.session.Context()
 	values := reflect.ValueOf(q.dstv.Elem().Interface())
 	for i := 0; i < values.Len(); i++ {
-		afterFind(values.Index(i))
+		afterFind(ctx, values.Index(i))
 	}
 	return nil
 
 }
 
-// empty fieldList updates all fields
+// fetch runs read on dst. When the session has a context, read decodes
+// into a new value that is only copied to dst if it finishes before the
+// context is done, see Session.wait.
+func (q *query) fetch(read func(dst interface{}) error) error {
+	return q.fetchInto(q.dstv, read)
+}
+
+// fetchInto is fetch for the pointer dstv rather than dst.
+func (q *query) fetchInto(dstv reflect.Value, read func(dst interface{}) error) error {
+	if q.session.ctx == nil || q.session.ctx.Done() == nil {
+		return read(dstv.Interface())
+	}
+	tmp := reflect.New(dstv.Elem().Type())
+	err := q.session.wait(func() error {
+		return read(tmp.Interface())
+	})
+	if err != nil {
+		return err
+	}
+	dstv.Elem().Set(tmp.Elem())
+	return nil
+}
+
+// Update writes dst to the records matching the query. fieldList limits
+// the update to the given db keys or Go field names, and an empty fieldList
+// updates all fields.
+//
+// Structs with a version field are updated by their primary key and stored
+// version within the query conditions, see Session.Save. db.ErrNoMoreRows
+// is returned if the record doesn't match the query conditions.
 func (q *query) Update(fieldList ...string) error {
+	if q.err != nil {
+		return q.err
+	}
+	if err := q.session.ctxErr(); err != nil {
+		return err
+	}
+	q.session.touch(q.dstv, false)
+	var sinfo *structInfo
+	if v := indirectStruct(q.dstv); v.IsValid() {
+		var err error
+		sinfo, err = getStructInfo(v.Type())
+		if err != nil {
+			return err
+		}
+		fieldList, err = fieldNames(sinfo, fieldList)
+		if err != nil {
+			return err
+		}
+		if fi := sinfo.UpdatedFieldInfo; fi != nil && len(fieldList) > 0 && !containsString(fieldList, fi.Name) {
+			fieldList = append(fieldList, fi.Name)
+		}
+	}
+	err := validate(q.dstv, fieldList...)
+	if err != nil {
+		return err
+	}
+	if sinfo != nil && sinfo.VersionFieldInfo != nil {
+		pk, err := q.session.getPrimaryKey(q.dstv)
+		if err != nil {
+			return err
+		}
+		if pk == nil {
+			return ErrNoPrimaryKey
+		}
+		return q.updateVersioned(pk, fieldList)
+	}
 	if len(fieldList) > 0 {
-		updateMap := make(map[string]interface{})
-		s := reflect.Indirect(q.dstv.Elem())
-		for _, field := range fieldList {
-			updateMap[field] = s.FieldByName(field).Interface()
+		v := indirectStruct(q.dstv)
+		if !v.IsValid() {
+			return db.ErrExpectingPointer
 		}
-		err := q.Result.Update(updateMap)
+		err := q.Result.Update(fieldValues(v, sinfo, fieldList...))
 		if err != nil {
 			return err
 		}
@@ -157,21 +471,96 @@ func (q *query) Update(fieldList ...string) error {
 	return nil
 }
 
-func (q *query) Remove() error {
-	item := q.dstv.Elem().Interface()
-	if i, ok := item.(CanBeforeDelete); ok {
-		err := i.BeforeDelete()
+// updateVersioned updates dst, which has a version field, by its primary key
+// pk and stored version along with the query conditions.
+func (q *query) updateVersioned(pk db.Cond, names []string) error {
+	cond, ok := q.equalityCond()
+	for k, v := range pk {
+		if !ok {
+			break
+		}
+		if cv, dup := cond[k]; dup && !reflect.DeepEqual(cv, v) {
+			ok = false
+		}
+		cond[k] = v
+	}
+	if !ok {
+		// NOTE: the check and the update aren't atomic
+		n, err := q.countWith(pk)
 		if err != nil {
 			return err
 		}
+		if n == 0 {
+			return db.ErrNoMoreRows
+		}
+		return q.session.update(q.Collection, q.dstv, pk, names...)
 	}
-	err := q.Result.Remove()
+
+	err := q.session.update(q.Collection, q.dstv, cond, names...)
+	if err == ErrStaleObject && len(cond) > len(pk) {
+		// tell a record outside the conditions from a stale one
+		n, cerr := q.countWith(pk)
+		if cerr != nil {
+			return cerr
+		}
+		if n == 0 {
+			return db.ErrNoMoreRows
+		}
+	}
+	return err
+}
+
+// countWith counts the records matching the query conditions and cond.
+func (q *query) countWith(cond db.Cond) (uint64, error) {
+	where := q.where()
+	conds := make([]interface{}, 0, len(where)+1)
+	conds = append(append(conds, where...), cond)
+	var n uint64
+	err := q.session.wait(func() (err error) {
+		n, err = q.Collection.Find(conds...).Count()
+		return
+	})
+	return n, err
+}
+
+// Remove deletes the records matching the query. Records with a softdelete
+// field are stamped with the current time instead of being removed. The
+// delete hooks only run on dst, see RemoveAll to run them per record.
+func (q *query) Remove() error {
+	if q.err != nil {
+		return q.err
+	}
+	if err := q.session.ctxErr(); err != nil {
+		return err
+	}
+	kind := HardDelete
+	if q.sinfo != nil && q.sinfo.DeletedFieldInfo != nil {
+		kind = SoftDelete
+	}
+	item := q.dstv.Elem().Interface()
+	err := beforeDelete(q.session.Context(), item, kind)
 	if err != nil {
 		return err
 	}
-	if i, ok := item.(CanAfterDelete); ok {
-		i.AfterDelete()
+	if kind == SoftDelete {
+		fi := q.sinfo.DeletedFieldInfo
+		now := q.session.Now()
+		if fi.UTC {
+			now = now.UTC()
+		}
+		err = q.Result.Update(map[string]interface{}{fi.Key: now})
+		if err == nil {
+			if v := indirectStruct(q.dstv); v.IsValid() {
+				setTime(v.FieldByIndex(fi.Index), now, fi.UTC)
+			}
+		}
+	} else {
+		err = q.Result.Remove()
+	}
+	if err != nil {
+		return err
 	}
+	q.session.afterDelete(item, kind)
 	return nil
 }
 
@@ -179,17 +568,108 @@ func (q *query) Close() error {
 	return q.Result.Close()
 }
 
+// keys translates the field names in v to db keys. Values that aren't
+// strings, ie. db.Raw, are left alone. When sort is true, names may be
+// prefixed with "-".
+func (q *query) keys(v []interface{}, sort bool) ([]interface{}, error) {
+	if q.sinfo == nil {
+		return v, nil
+	}
+	keys := make([]interface{}, len(v))
+	for i, name := range v {
+		str, ok := name.(string)
+		if !ok {
+			keys[i] = name
+			continue
+		}
+		prefix := ""
+		if sort && strings.HasPrefix(str, "-") {
+			prefix, str = "-", str[1:]
+		}
+		key, err := q.sinfo.key(str)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = prefix + key
+	}
+	return keys, nil
+}
+
+// translateConds translates the keys of db.Cond conditions, including those
+// nested in db.And and db.Or, from field names to db keys. A key may be
+// followed by an operator, ie. "Age >".
+func (q *query) translateConds(conds []interface{}) ([]interface{}, error) {
+	if q.sinfo == nil {
+		return conds, nil
+	}
+	out := make([]interface{}, len(conds))
+	for i, c := range conds {
+		var err error
+		switch c := c.(type) {
+		case db.Cond:
+			out[i], err = q.translateCond(c)
+		case db.And:
+			var and []interface{}
+			and, err = q.translateConds(c)
+			out[i] = db.And(and)
+		case db.Or:
+			var or []interface{}
+			or, err = q.translateConds(c)
+			out[i] = db.Or(or)
+		default:
+			out[i] = c
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func (q *query) translateCond(cond db.Cond) (db.Cond, error) {
+	out := make(db.Cond, len(cond))
+	for k, v := range cond {
+		name, op := k, ""
+		if i := strings.Index(k, " "); i > 0 {
+			name, op = k[:i], k[i:]
+		}
+		if strings.HasPrefix(name, "$") {
+			out[k] = v
+			continue
+		}
+		key, err := q.sinfo.key(name)
+		if err != nil {
+			return nil, err
+		}
+		out[key+op] = v
+	}
+	return out, nil
+}
+
+// fieldNames translates db keys or Go field names to Go field names.
+func fieldNames(sinfo *structInfo, names []string) ([]string, error) {
+	out := make([]string, len(names))
+	for i, name := range names {
+		fi := sinfo.field(name)
+		if fi == nil {
+			return nil, &UnknownFieldError{Type: sinfo.Zero.Type(), Name: name}
+		}
+		out[i] = fi.Name
+	}
+	return out, nil
+}
+
 //Called after a find. Converts time fields that need it to UTC and calls AfterFind if exists
-func afterFind(val reflect.Value) {
+func afterFind(ctx context.Context, val reflect.Value) {
 	//Set time to UTC
 	for val.Kind() == reflect.Ptr {
 		val = val.Elem()
 	}
-	si := structMap[val.Type()]
-	if si != nil {
+	si, err := getStructInfo(val.Type())
+	if err == nil {
 		for _, fi := range si.FieldsList {
 			if fi.UTC {
-				field := val.FieldByName(fi.Name)
+				field := val.FieldByIndex(fi.Index)
 				if field.Kind() != reflect.Ptr {
 					field.Set(reflect.ValueOf(field.Interface().(time.Time).UTC()))
 				} else { // field is a pointer
@@ -202,8 +682,12 @@ func afterFind(val reflect.Value) {
 			}
 		}
 	}
+	snapshot(val)
 	//call structs after find method if possible
 	if i, ok := val.Addr().Interface().(CanAfterFind); ok {
 		i.AfterFind()
 	}
+	if i, ok := val.Addr().Interface().(CanAfterFindContext); ok {
+		i.AfterFindContext(ctx)
+	}
 }
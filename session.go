@@ -1,9 +1,12 @@
 package bondb
 
 import (
+	"context"
 	"fmt"
 	"reflect"
+	"strings"
 	"sync"
+	"time"
 
 	"upper.io/db"
 )
@@ -11,8 +14,41 @@ import (
 type Session struct {
 	db.Database
 
-	collections     map[string]db.Collection
-	collectionsLock sync.Mutex
+	// Now returns the current time, used for the created and updated
+	// fields. It defaults to time.Now and can be replaced in tests.
+	Now func() time.Time
+
+	// CollectionNamer names the collection of struct types that neither
+	// implement CanCollectionName nor are registered with
+	// RegisterCollection, ie. PluralSnakeCase. When nil, such types return
+	// ErrUnknownCollectionName.
+	CollectionNamer func(t reflect.Type) string
+
+	// PageTokenKey signs the page tokens of query.Page with HMAC-SHA256
+	// when set, so that clients can't forge them.
+	PageTokenKey []byte
+
+	ctx     context.Context
+	adapter string
+	tx      *txState // nil unless the session is a transaction
+	cache   *collectionCache
+}
+
+// collectionCache holds the collections and registrations of a session. It
+// is shared by a session and the sessions derived from it with WithContext.
+type collectionCache struct {
+	sync.Mutex
+	collections map[string]db.Collection
+	names       map[reflect.Type]string // registered with RegisterCollection
+	generators  map[string]Generator    // registered with RegisterGenerator
+}
+
+func newCollectionCache() *collectionCache {
+	return &collectionCache{
+		collections: make(map[string]db.Collection),
+		names:       make(map[reflect.Type]string),
+		generators:  make(map[string]Generator),
+	}
 }
 
 func NewSession(adapter string, url db.ConnectionURL) (*Session, error) {
@@ -20,10 +56,19 @@ func NewSession(adapter string, url db.ConnectionURL) (*Session, error) {
 	if err != nil {
 		return nil, err
 	}
-	session := &Session{Database: d, collections: make(map[string]db.Collection)}
+	session := &Session{
+		Database: d,
+		Now:      time.Now,
+		adapter:  adapter,
+		cache:    newCollectionCache(),
+	}
 	return session, nil
 }
 
+// Query returns a query of the collection of dst, into which its results
+// are fetched. Queries are immutable: Where, Sort, Limit and the other
+// builders return a new query and leave their receiver unchanged, so their
+// return value must be used, ie. q = q.Where(cond).
 func (s *Session) Query(dst interface{}) *query {
 	return NewQuery(s, dst)
 }
@@ -34,50 +79,77 @@ func (s *Session) Q(dst interface{}) *query {
 }
 
 func (s *Session) Create(item interface{}) (interface{}, error) {
+	if err := s.ctxErr(); err != nil {
+		return nil, err
+	}
 	col, err := s.GetCollection(item)
 	if err != nil {
 		return nil, err
 	}
-	if i, ok := item.(CanBeforeSave); ok {
-		err := i.BeforeSave()
-		if err != nil {
-			return nil, err
-		}
+	err = s.beforeInsert(col, reflect.ValueOf(item))
+	if err != nil {
+		return nil, err
 	}
 	oid, err := col.Append(item)
 	if err != nil {
 		return nil, err
 	}
-	if i, ok := item.(CanAfterSave); ok {
-		i.AfterSave()
-	}
+	s.afterSave(item)
 	return oid, nil
 }
 
+// beforeInsert prepares a new item for its insert: it generates its primary
+// key, sets its created, updated and version fields, runs BeforeSave and
+// validates it.
+func (s *Session) beforeInsert(col db.Collection, itemv reflect.Value) error {
+	err := s.generateKey(itemv, col)
+	if err != nil {
+		return err
+	}
+	s.touch(itemv, true)
+	initVersion(itemv)
+	err = beforeSave(s.Context(), itemv.Interface())
+	if err != nil {
+		return err
+	}
+	return validate(itemv)
+}
+
 func (s *Session) Save(item interface{}) error {
+	if err := s.ctxErr(); err != nil {
+		return err
+	}
 	col, err := s.GetCollection(item)
 	if err != nil {
 		return err
 	}
 
 	itemv := reflect.ValueOf(item)
-	oid, idkey, err := s.getPrimaryKey(itemv)
+	pk, err := s.getPrimaryKey(itemv)
 	if err != nil {
 		return err
 	}
-	if idkey == "" {
-		panic("Save() expects a struct with a 'pk' tag defined")
-	}
-
-	if i, ok := item.(CanBeforeSave); ok {
-		err := i.BeforeSave()
+	isNew := pk == nil
+	if isNew {
+		err = s.generateKey(itemv, col)
 		if err != nil {
 			return err
 		}
+		initVersion(itemv)
 	}
-	if oid == nil {
+	s.touch(itemv, isNew)
+
+	err = beforeSave(s.Context(), item)
+	if err != nil {
+		return err
+	}
+	err = validate(itemv)
+	if err != nil {
+		return err
+	}
+	if isNew {
 		// New
-		oid, err = col.Append(item)
+		oid, err := col.Append(item)
 		if err != nil {
 			return err
 		}
@@ -86,44 +158,157 @@ func (s *Session) Save(item interface{}) error {
 			return err
 		}
 	} else {
-		// Existing
-		err := col.Find(db.Cond{idkey: oid}).Update(item)
+		err = s.updateChanges(col, itemv, pk)
 		if err != nil {
 			return err
 		}
 	}
-	if i, ok := item.(CanAfterSave); ok {
-		i.AfterSave()
-	}
+	snapshot(indirectStruct(itemv))
+	s.afterSave(item)
 	return nil
 }
 
+// updateChanges writes an existing item, matching pk, to col. Tracked items
+// only write the fields that changed.
+func (s *Session) updateChanges(col db.Collection, itemv reflect.Value, pk db.Cond) error {
+	v := indirectStruct(itemv)
+	sinfo, err := getStructInfo(v.Type())
+	if err != nil {
+		return err
+	}
+	cs, err := changes(v, sinfo)
+	switch {
+	case err == ErrNotTracked:
+		return s.update(col, itemv, pk)
+	case err == nil && len(cs) > 0:
+		names := make([]string, len(cs))
+		for i, c := range cs {
+			names[i] = c.Name
+		}
+		return s.update(col, itemv, pk, names...)
+	}
+	return err
+}
+
+// Delete removes the item from the database. Items with a softdelete field
+// have it set to the current time instead, see Restore and Purge.
 func (s *Session) Delete(item interface{}) error {
+	return s.delete(item, false)
+}
+
+// Purge removes the item from the database, even if it has a softdelete
+// field.
+func (s *Session) Purge(item interface{}) error {
+	return s.delete(item, true)
+}
+
+func (s *Session) delete(item interface{}, purge bool) error {
+	if err := s.ctxErr(); err != nil {
+		return err
+	}
 	col, err := s.GetCollection(item)
 	if err != nil {
 		return err
 	}
-	if i, ok := item.(CanBeforeDelete); ok {
-		err := i.BeforeDelete()
+	itemv := reflect.ValueOf(item)
+	var fi *fieldInfo
+	if v := indirectStruct(itemv); v.IsValid() && !purge {
+		sinfo, err := getStructInfo(v.Type())
 		if err != nil {
 			return err
 		}
+		fi = sinfo.DeletedFieldInfo
+	}
+	kind := HardDelete
+	if fi != nil {
+		kind = SoftDelete
+	}
+
+	err = beforeDelete(s.Context(), item, kind)
+	if err != nil {
+		return err
+	}
+	pk, err := s.getPrimaryKey(itemv)
+	if err != nil {
+		return err
+	}
+	if pk == nil {
+		return ErrNoPrimaryKey
+	}
+	if kind == SoftDelete {
+		err = s.setDeleted(col, itemv, fi, pk, s.Now())
+	} else {
+		err = col.Find(pk).Remove()
+	}
+	if err != nil {
+		return err
+	}
+	s.afterDelete(item, kind)
+	return nil
+}
+
+// Restore undoes the soft delete of an item.
+func (s *Session) Restore(item interface{}) error {
+	if err := s.ctxErr(); err != nil {
+		return err
+	}
+	col, err := s.GetCollection(item)
+	if err != nil {
+		return err
 	}
 	itemv := reflect.ValueOf(item)
-	oid, idkey, err := s.getPrimaryKey(itemv)
+	v := indirectStruct(itemv)
+	if !v.IsValid() {
+		return db.ErrExpectingPointer
+	}
+	sinfo, err := getStructInfo(v.Type())
 	if err != nil {
 		return err
 	}
-	err = col.Find(db.Cond{idkey: oid}).Remove()
+	fi := sinfo.DeletedFieldInfo
+	if fi == nil {
+		return fmt.Errorf("%s has no softdelete field", v.Type())
+	}
+	pk, err := s.getPrimaryKey(itemv)
 	if err != nil {
 		return err
 	}
-	if i, ok := item.(CanAfterDelete); ok {
-		i.AfterDelete()
+	return s.setDeleted(col, itemv, fi, pk, time.Time{})
+}
+
+// setDeleted writes t to the softdelete field of the item, a zero t marks
+// the item as not deleted.
+func (s *Session) setDeleted(col db.Collection, itemv reflect.Value, fi *fieldInfo, pk db.Cond, t time.Time) error {
+	if pk == nil {
+		return ErrNoPrimaryKey
+	}
+	var value interface{}
+	if t.IsZero() {
+		value = fi.Zero.Interface()
+	} else {
+		if fi.UTC {
+			t = t.UTC()
+		}
+		value = t
+	}
+	err := col.Find(pk).Update(map[string]interface{}{fi.Key: value})
+	if err != nil {
+		return err
+	}
+	if v := indirectStruct(itemv); v.CanSet() {
+		if t.IsZero() {
+			v.FieldByIndex(fi.Index).Set(fi.Zero)
+		} else {
+			setTime(v.FieldByIndex(fi.Index), t, fi.UTC)
+		}
 	}
 	return nil
 }
 
+// Collection returns the collection for name, and panics if it can't be
+// looked up.
+//
+// Deprecated: use GetCollection, which returns the error instead.
 func (s *Session) Collection(name string) db.Collection {
 	col, err := s.GetCollection(name)
 	if err != nil {
@@ -132,24 +317,48 @@ func (s *Session) Collection(name string) db.Collection {
 	return col
 }
 
+// RegisterCollection maps the struct type of item to the collection name,
+// for types that don't implement CanCollectionName.
+func (s *Session) RegisterCollection(item interface{}, name string) {
+	st := structType(reflect.TypeOf(item))
+	if st == nil {
+		return
+	}
+	s.cache.Lock()
+	s.cache.names[st] = name
+	s.cache.Unlock()
+}
+
+// GetCollection returns the collection for item, which is either the name
+// of the collection or a value of a struct type. The name for a struct type
+// is looked up in order from:
+//
+//   - its CollectionName method, on a pointer or value receiver
+//   - the CollectionName method of an embedded struct
+//   - the mapping registered with RegisterCollection
+//   - the session's CollectionNamer
 func (s *Session) GetCollection(item interface{}) (db.Collection, error) {
 	var colName string
 	if str, ok := item.(string); ok {
 		colName = str
 	}
 	if colName == "" {
-		if i, ok := item.(CanCollectionName); ok {
+		if i, ok := item.(CanCollectionName); ok && !isNilPtr(item) {
 			colName = i.CollectionName()
 		}
 	}
+
+	s.cache.Lock()
+	defer s.cache.Unlock()
+
+	if colName == "" && item != nil {
+		colName = s.collectionName(reflect.TypeOf(item))
+	}
 	if colName == "" {
 		return nil, ErrUnknownCollectionName
 	}
 
-	s.collectionsLock.Lock()
-	defer s.collectionsLock.Unlock()
-
-	col, found := s.collections[colName]
+	col, found := s.cache.collections[colName]
 	if found {
 		return col, nil
 	}
@@ -157,13 +366,66 @@ func (s *Session) GetCollection(item interface{}) (db.Collection, error) {
 	if err != nil && err != db.ErrCollectionDoesNotExist {
 		return nil, err
 	}
-	s.collections[colName] = col
+	s.cache.collections[colName] = col
 	return col, nil
 }
 
+// collectionName returns the collection name of the struct type behind t,
+// or "" if it has none. The caller must hold the cache lock.
+func (s *Session) collectionName(t reflect.Type) string {
+	st := structType(t)
+	if st == nil {
+		return ""
+	}
+	if name := methodCollectionName(st); name != "" {
+		return name
+	}
+	if name, ok := s.cache.names[st]; ok {
+		return name
+	}
+	if s.CollectionNamer != nil {
+		return s.CollectionNamer(st)
+	}
+	return ""
+}
+
+var collectionNameType = reflect.TypeOf((*CanCollectionName)(nil)).Elem()
+
+// methodCollectionName returns the name from the CollectionName method of
+// st, or of the first inline or anonymous embedded struct that has one.
+func methodCollectionName(st reflect.Type) string {
+	if reflect.PtrTo(st).Implements(collectionNameType) {
+		return reflect.New(st).Interface().(CanCollectionName).CollectionName()
+	}
+	for i := 0; i < st.NumField(); i++ {
+		field := st.Field(i)
+		if field.Type.Kind() != reflect.Struct {
+			continue
+		}
+		inline := field.Anonymous
+		for _, key := range []string{"db", "field", "bson"} {
+			if containsString(strings.Split(field.Tag.Get(key), ",")[1:], "inline") {
+				inline = true
+			}
+		}
+		if !inline {
+			continue
+		}
+		if name := methodCollectionName(field.Type); name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+func isNilPtr(item interface{}) bool {
+	v := reflect.ValueOf(item)
+	return v.Kind() == reflect.Ptr && v.IsNil()
+}
+
 func (s *Session) ReflectCollection(v reflect.Value) (db.Collection, error) {
 	var item interface{}
-	if v.IsNil() || v.Kind() != reflect.Ptr {
+	if v.Kind() != reflect.Ptr || v.IsNil() {
 		return nil, db.ErrExpectingPointer
 	}
 	if v.Elem().Kind() == reflect.Slice {
@@ -176,9 +438,118 @@ func (s *Session) ReflectCollection(v reflect.Value) (db.Collection, error) {
 	return s.GetCollection(item)
 }
 
-func (s *Session) getPrimaryKey(itemv reflect.Value) (interface{}, string, error) {
+// update writes the item matching cond, its primary key condition, see
+// getPrimaryKey, possibly along with further equality conditions, to col.
+// When names is non-empty, only the fields with those Go names are written.
+// Items with a version field only match their stored version, which is then
+// incremented, and ErrStaleObject is returned if the stored version has
+// moved on.
+func (s *Session) update(col db.Collection, itemv reflect.Value, cond db.Cond, names ...string) error {
+	v := indirectStruct(itemv)
+	if !v.IsValid() {
+		return db.ErrExpectingPointer
+	}
+	sinfo, err := getStructInfo(v.Type())
+	if err != nil {
+		return err
+	}
+
+	fi := sinfo.VersionFieldInfo
+	if fi == nil {
+		if len(names) > 0 {
+			return col.Find(cond).Update(fieldValues(v, sinfo, names...))
+		}
+		return col.Find(cond).Update(itemv.Interface())
+	}
+
+	drv, err := s.driver()
+	if err != nil {
+		return err
+	}
+	version := v.FieldByIndex(fi.Index)
+	next := reflect.New(version.Type()).Elem()
+	if k := version.Kind(); k >= reflect.Int && k <= reflect.Int64 {
+		next.SetInt(version.Int() + 1)
+	} else {
+		next.SetUint(version.Uint() + 1)
+	}
+
+	values := fieldValues(v, sinfo, names...)
+	values[fi.Key] = next.Interface()
+	where := make(db.Cond, len(cond)+1)
+	for k, v := range cond {
+		where[k] = v
+	}
+	where[fi.Key] = version.Interface()
+	n, err := drv.update(col.Name(), where, values)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrStaleObject
+	}
+	version.Set(next)
+	return nil
+}
+
+// initVersion sets a zero version field of the item to 1 before its insert.
+func initVersion(itemv reflect.Value) {
+	v := indirectStruct(itemv)
+	if !v.IsValid() || !v.CanSet() {
+		return
+	}
+	sinfo, err := getStructInfo(v.Type())
+	if err != nil || sinfo.VersionFieldInfo == nil {
+		return
+	}
+	version := v.FieldByIndex(sinfo.VersionFieldInfo.Index)
+	if isZero(version) {
+		if k := version.Kind(); k >= reflect.Int && k <= reflect.Int64 {
+			version.SetInt(1)
+		} else {
+			version.SetUint(1)
+		}
+	}
+}
+
+// touch sets the updated field of the item to the current time, and the
+// created field as well when created is true. Items that aren't addressable
+// are skipped.
+func (s *Session) touch(itemv reflect.Value, created bool) {
+	v := indirectStruct(itemv)
+	if !v.IsValid() || !v.CanSet() {
+		return
+	}
+	sinfo, err := getStructInfo(v.Type())
+	if err != nil {
+		return
+	}
+	now := s.Now()
+	if fi := sinfo.CreatedFieldInfo; fi != nil && created {
+		setTime(v.FieldByIndex(fi.Index), now, fi.UTC)
+	}
+	if fi := sinfo.UpdatedFieldInfo; fi != nil {
+		setTime(v.FieldByIndex(fi.Index), now, fi.UTC)
+	}
+}
+
+func setTime(field reflect.Value, t time.Time, utc bool) {
+	if utc {
+		t = t.UTC()
+	}
+	if field.Kind() == reflect.Ptr {
+		field.Set(reflect.ValueOf(&t))
+	} else {
+		field.Set(reflect.ValueOf(t))
+	}
+}
+
+// getPrimaryKey returns the condition matching the item by its primary key,
+// with a value for each of its fields. The condition is nil when any of the
+// fields is zero, as for a new item.
+func (s *Session) getPrimaryKey(itemv reflect.Value) (db.Cond, error) {
 	if itemv.Kind() != reflect.Ptr {
-		return nil, "", db.ErrExpectingPointer
+		return nil, db.ErrExpectingPointer
 	}
 	itemp := reflect.Indirect(itemv)
 
@@ -191,52 +562,25 @@ func (s *Session) getPrimaryKey(itemv reflect.Value) (interface{}, string, error
 			i = reflect.New(itemp.Type().Elem()).Elem()
 		}
 	}
-	if !i.IsValid() {
-		panic(fmt.Sprintf("invalid type passed: %v", itemv.Type()))
+	if !i.IsValid() || i.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("expecting a pointer to a struct, got %v", itemv.Type())
 	}
 
 	sinfo, err := getStructInfo(i.Type())
 	if err != nil {
-		return nil, "", err
-	}
-	pkInfo := sinfo.PKFieldInfo
-	if pkInfo == nil {
-		return nil, pkInfo.Key, nil // ...? hmm.. return error...?
+		return nil, err
 	}
-
-	pk := i.FieldByName(pkInfo.Name)
-	v := pk.Interface()
-	z := pkInfo.Zero.Interface()
-
-	if v == nil || v == z {
-		return nil, pkInfo.Key, nil
+	if len(sinfo.PKFieldsList) == 0 {
+		return nil, ErrNoPrimaryKey
 	}
-	return v, pkInfo.Key, nil
-}
 
-func (s *Session) setPrimaryKey(itemv reflect.Value, oid interface{}) error {
-	if itemv.Kind() != reflect.Ptr {
-		return nil // skip, we need a pointer
-	}
-	itemp := reflect.Indirect(itemv)
-	sinfo, err := getStructInfo(itemp.Type())
-	if err != nil {
-		return err
-	}
-	if sinfo.PKFieldInfo != nil {
-		fi := sinfo.PKFieldInfo
-		item := itemp.Interface()
-		_, setter1 := item.(db.IDSetter)
-		_, setter2 := item.(db.Int64IDSetter)
-		_, setter3 := item.(db.Uint64IDSetter)
-		if !(setter1 || setter2 || setter3) {
-			f := itemp.FieldByName(fi.Name)
-			if f.CanSet() {
-				f.Set(reflect.ValueOf(oid))
-			} else {
-				panic(fmt.Sprintf("cannot set the value of type:%s field:sq", itemp.Type(), fi.Name))
-			}
+	pk := make(db.Cond, len(sinfo.PKFieldsList))
+	for _, fi := range sinfo.PKFieldsList {
+		f := i.FieldByIndex(fi.Index)
+		if isZero(f) {
+			return nil, nil
 		}
+		pk[fi.Key] = f.Interface()
 	}
-	return nil
+	return pk, nil
 }
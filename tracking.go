@@ -0,0 +1,141 @@
+package bondb
+
+import (
+	"errors"
+	"reflect"
+
+	"upper.io/db"
+)
+
+// ErrNotTracked is returned by Session.Changes for items that don't embed
+// Tracked, or that haven't been loaded or saved yet.
+var ErrNotTracked = errors.New("item is not tracked")
+
+// Tracked can be embedded in a model to track changes to its fields. Models
+// loaded by a query keep a snapshot of their persisted values, and
+// Session.Save then only writes the fields that changed since. Embed it with
+// a "-" key so it isn't stored, ie:
+//
+//	type Account struct {
+//		bondb.Tracked `bson:"-" db:"-"`
+//		...
+//	}
+type Tracked struct {
+	snapshot map[string]interface{} // by db key
+}
+
+func (t *Tracked) tracked() *Tracked {
+	return t
+}
+
+type canTrack interface {
+	tracked() *Tracked
+}
+
+// Change describes a field whose value differs from the snapshot.
+type Change struct {
+	Name string      // Go field name
+	Key  string      // db field key
+	Old  interface{} // value when the item was loaded or last saved
+	New  interface{} // current value
+}
+
+// Changes returns the fields of the item that changed since it was loaded
+// or last saved.
+func (s *Session) Changes(item interface{}) ([]Change, error) {
+	v := indirectStruct(reflect.ValueOf(item))
+	if !v.IsValid() {
+		return nil, db.ErrExpectingPointer
+	}
+	sinfo, err := getStructInfo(v.Type())
+	if err != nil {
+		return nil, err
+	}
+	return changes(v, sinfo)
+}
+
+func changes(v reflect.Value, sinfo *structInfo) ([]Change, error) {
+	t := tracker(v)
+	if t == nil || t.snapshot == nil {
+		return nil, ErrNotTracked
+	}
+	var changes []Change
+	for _, fi := range sinfo.FieldsList {
+		cur := v.FieldByIndex(fi.Index).Interface()
+		old, ok := t.snapshot[fi.Key]
+		if !ok || !reflect.DeepEqual(old, cur) {
+			changes = append(changes, Change{Name: fi.Name, Key: fi.Key, Old: old, New: cur})
+		}
+	}
+	return changes, nil
+}
+
+// tracker returns the Tracked embedded in the struct v, or nil.
+func tracker(v reflect.Value) *Tracked {
+	if !v.CanAddr() {
+		return nil
+	}
+	if i, ok := v.Addr().Interface().(canTrack); ok {
+		return i.tracked()
+	}
+	return nil
+}
+
+// snapshot records the current field values of the struct v, if it embeds
+// Tracked.
+func snapshot(v reflect.Value) {
+	t := tracker(v)
+	if t == nil {
+		return
+	}
+	sinfo, err := getStructInfo(v.Type())
+	if err != nil {
+		return
+	}
+	t.snapshot = make(map[string]interface{}, len(sinfo.FieldsList))
+	for _, fi := range sinfo.FieldsList {
+		t.snapshot[fi.Key] = deepCopy(v.FieldByIndex(fi.Index)).Interface()
+	}
+}
+
+// deepCopy returns a copy of v that shares no slices, maps or pointers with
+// it, so later changes to v can be detected.
+func deepCopy(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type().Elem())
+		c.Elem().Set(deepCopy(v.Elem()))
+		return c
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(deepCopy(v.Index(i)))
+		}
+		return c
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeMap(v.Type())
+		for _, k := range v.MapKeys() {
+			c.SetMapIndex(k, deepCopy(v.MapIndex(k)))
+		}
+		return c
+	case reflect.Struct:
+		c := reflect.New(v.Type()).Elem()
+		c.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if f := c.Field(i); f.CanSet() {
+				f.Set(deepCopy(v.Field(i)))
+			}
+		}
+		return c
+	}
+	return v
+}
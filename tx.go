@@ -0,0 +1,154 @@
+package bondb
+
+import (
+	"errors"
+	"sync"
+
+	"upper.io/db"
+)
+
+var (
+	// ErrTxUnsupported is returned by Begin and Tx when the database adapter
+	// doesn't support transactions, ie. mongo, and within a transaction by
+	// operations that need to run statements on it, ie. versioned updates,
+	// Upsert or Apply, when the adapter's transaction type can't.
+	ErrTxUnsupported = errors.New("transactions are not supported by the database adapter")
+
+	// ErrNotInTx is returned by Commit and Rollback on a session that isn't
+	// a transaction.
+	ErrNotInTx = errors.New("session is not a transaction")
+
+	// ErrTxDone is returned by Begin when called on a session that is
+	// already a transaction, and by Commit and Rollback once the
+	// transaction has been committed or rolled back.
+	ErrTxDone = errors.New("transaction already begun or finished")
+)
+
+// Begin starts a transaction, returning a session that runs its queries and
+// writes within it. AfterSave and AfterDelete hooks of the transaction are
+// deferred until Commit, and dropped on Rollback.
+func (s *Session) Begin() (*Session, error) {
+	if s.tx != nil {
+		return nil, ErrTxDone
+	}
+	tx, err := s.Database.Transaction()
+	if err == db.ErrUnsupported {
+		return nil, ErrTxUnsupported
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// collections of the transaction are cached apart from the session's
+	cache := newCollectionCache()
+	s.cache.Lock()
+	for t, name := range s.cache.names {
+		cache.names[t] = name
+	}
+	for name, gen := range s.cache.generators {
+		cache.generators[name] = gen
+	}
+	s.cache.Unlock()
+
+	return &Session{
+		Database:        tx,
+		Now:             s.Now,
+		CollectionNamer: s.CollectionNamer,
+		PageTokenKey:    s.PageTokenKey,
+		ctx:             s.ctx,
+		adapter:         s.adapter,
+		tx:              &txState{Tx: tx},
+		cache:           cache,
+	}, nil
+}
+
+// txState is shared by a transaction and the sessions derived from it with
+// WithContext.
+type txState struct {
+	db.Tx
+	sync.Mutex
+	hooks []func() // after hooks deferred until commit
+	done  bool
+}
+
+// Commit commits the transaction and runs its deferred hooks.
+func (s *Session) Commit() error {
+	hooks, err := s.finishTx()
+	if err != nil {
+		return err
+	}
+	err = s.tx.Commit()
+	if err != nil {
+		return err
+	}
+	for _, fn := range hooks {
+		fn()
+	}
+	return nil
+}
+
+// Rollback aborts the transaction and drops its deferred hooks.
+func (s *Session) Rollback() error {
+	_, err := s.finishTx()
+	if err != nil {
+		return err
+	}
+	return s.tx.Rollback()
+}
+
+func (s *Session) finishTx() ([]func(), error) {
+	if s.tx == nil {
+		return nil, ErrNotInTx
+	}
+	s.tx.Lock()
+	defer s.tx.Unlock()
+	if s.tx.done {
+		return nil, ErrTxDone
+	}
+	s.tx.done = true
+	hooks := s.tx.hooks
+	s.tx.hooks = nil
+	return hooks, nil
+}
+
+// Tx runs fn in a transaction, which is committed if fn returns nil and
+// rolled back if it returns an error or panics.
+func (s *Session) Tx(fn func(tx *Session) error) (err error) {
+	tx, err := s.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// afterHook runs fn, or defers it until Commit when s is a transaction.
+func (s *Session) afterHook(fn func()) {
+	if s.tx == nil {
+		fn()
+		return
+	}
+	s.tx.Lock()
+	s.tx.hooks = append(s.tx.hooks, fn)
+	s.tx.Unlock()
+}
+
+func (s *Session) afterSave(item interface{}) {
+	ctx := s.Context()
+	s.afterHook(func() { afterSave(ctx, item) })
+}
+
+func (s *Session) afterDelete(item interface{}, kind DeleteKind) {
+	ctx := s.Context()
+	s.afterHook(func() { afterDelete(ctx, item, kind) })
+}
@@ -0,0 +1,358 @@
+package bondb
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"upper.io/db"
+)
+
+// upsert describes an insert that turns into an update when a record with
+// the same keys exists.
+type upsert struct {
+	keys      db.Cond                // natural key the record is matched by
+	set       map[string]interface{} // written on insert and update
+	insert    map[string]interface{} // only written on insert
+	version   string                 // key incremented on update and set to 1 on insert, if any
+	returning []string               // keys of the record to return, ie. the primary key
+}
+
+// Upsert inserts the item, or updates the record that has the same values
+// for keyFields, which may be db keys or Go field names and default to the
+// primary key. It returns whether the item was inserted, and sets the
+// primary key of the item either way.
+//
+// On mongo and postgresql the upsert is a single atomic operation, which on
+// postgresql requires a unique constraint on the key fields. Other adapters
+// look up the record and then insert or update it, so concurrent upserts of
+// a key may race unless the database rejects duplicate keys.
+//
+// BeforeSave and AfterSave run as for Save. The created field is only
+// written on insert, and the version field is incremented on update without
+// checking the version of the item.
+func (s *Session) Upsert(item interface{}, keyFields ...string) (bool, error) {
+	if err := s.ctxErr(); err != nil {
+		return false, err
+	}
+	col, err := s.GetCollection(item)
+	if err != nil {
+		return false, err
+	}
+	itemv := reflect.ValueOf(item)
+	v := indirectStruct(itemv)
+	if !v.IsValid() || !v.CanSet() {
+		return false, db.ErrExpectingPointer
+	}
+	sinfo, err := getStructInfo(v.Type())
+	if err != nil {
+		return false, err
+	}
+	keys, err := upsertKeys(sinfo, keyFields)
+	if err != nil {
+		return false, err
+	}
+
+	err = s.generateKey(itemv, col)
+	if err != nil {
+		return false, err
+	}
+	s.touch(itemv, true)
+	initVersion(itemv)
+	err = beforeSave(s.Context(), item)
+	if err != nil {
+		return false, err
+	}
+	err = validate(itemv)
+	if err != nil {
+		return false, err
+	}
+	cond := keyCond(v, keys)
+	for _, fi := range keys {
+		if fi.PK && cond[fi.Key] == nil {
+			return false, ErrNoPrimaryKey
+		}
+	}
+
+	inserted, err := s.upsert(col, itemv, sinfo, cond, false)
+	if err == db.ErrUnsupported {
+		inserted, err = s.upsertFallback(col, itemv, sinfo, cond)
+	}
+	if err != nil {
+		return false, err
+	}
+	snapshot(v)
+	s.afterSave(item)
+	return inserted, nil
+}
+
+// FindOrCreate loads the record matching cond into dst, or creates it from
+// cond and defaults if there is none. The keys of cond and defaults may be
+// db keys or Go field names, and cond only holds equality conditions. It
+// returns whether the record was created.
+//
+// The record is looked up first, and only if it is missing is the new item
+// validated and inserted. On mongo and postgresql the insert is a single
+// atomic operation along with a second lookup, see Upsert, so concurrent
+// calls create a single record.
+//
+// BeforeSave runs on the new item before it is known whether a concurrent
+// call created the record meanwhile, AfterSave only if it was created, and
+// AfterFind if the record existed.
+func (s *Session) FindOrCreate(dst interface{}, cond db.Cond, defaults map[string]interface{}) (bool, error) {
+	if err := s.ctxErr(); err != nil {
+		return false, err
+	}
+	col, err := s.GetCollection(dst)
+	if err != nil {
+		return false, err
+	}
+	dstv := reflect.ValueOf(dst)
+	v := indirectStruct(dstv)
+	if !v.IsValid() || !v.CanSet() {
+		return false, db.ErrExpectingPointer
+	}
+	sinfo, err := getStructInfo(v.Type())
+	if err != nil {
+		return false, err
+	}
+
+	keys := make([]*fieldInfo, 0, len(cond))
+	for name := range cond {
+		if strings.ContainsAny(name, " $") {
+			return false, fmt.Errorf("bondb: FindOrCreate expects equality conditions, got %q", name)
+		}
+		fi := sinfo.field(name)
+		if fi == nil {
+			return false, &UnknownFieldError{Type: sinfo.Zero.Type(), Name: name}
+		}
+		keys = append(keys, fi)
+	}
+	v.Set(sinfo.Zero)
+	err = setFields(v, sinfo, cond)
+	if err != nil {
+		return false, err
+	}
+	where := keyCond(v, keys)
+	err = NewQuery(s, dst).WithDeleted().Where(where).One()
+	if err != db.ErrNoMoreRows {
+		return false, err
+	}
+
+	v.Set(sinfo.Zero)
+	err = setFields(v, sinfo, defaults)
+	if err != nil {
+		return false, err
+	}
+	err = setFields(v, sinfo, cond)
+	if err != nil {
+		return false, err
+	}
+
+	err = s.generateKey(dstv, col)
+	if err != nil {
+		return false, err
+	}
+	s.touch(dstv, true)
+	initVersion(dstv)
+	err = beforeSave(s.Context(), dst)
+	if err != nil {
+		return false, err
+	}
+	err = validate(dstv)
+	if err != nil {
+		return false, err
+	}
+
+	created, err := s.upsert(col, dstv, sinfo, where, true)
+	if err == db.ErrUnsupported {
+		created, err = s.createFallback(col, dstv, where)
+	}
+	if err != nil {
+		return false, err
+	}
+	if created {
+		snapshot(v)
+		s.afterSave(dst)
+		return true, nil
+	}
+
+	v.Set(sinfo.Zero)
+	return false, NewQuery(s, dst).WithDeleted().Where(where).One()
+}
+
+// upsert runs the upsert natively through the session's driver. With
+// insertOnly, an existing record is left as is. It returns db.ErrUnsupported
+// when the adapter has no native upsert.
+func (s *Session) upsert(col db.Collection, itemv reflect.Value, sinfo *structInfo, cond db.Cond, insertOnly bool) (bool, error) {
+	drv, err := s.driver()
+	if err != nil {
+		return false, err
+	}
+	v := indirectStruct(itemv)
+	u := &upsert{
+		keys:   cond,
+		set:    make(map[string]interface{}),
+		insert: make(map[string]interface{}),
+	}
+	for k, val := range cond {
+		u.insert[k] = val
+	}
+	for _, fi := range sinfo.FieldsList {
+		if fi.PK || fi.Created || fi.Version {
+			u.returning = append(u.returning, fi.Key)
+		}
+		if _, ok := cond[fi.Key]; ok {
+			continue
+		}
+		f := v.FieldByIndex(fi.Index)
+		switch {
+		case fi.PK:
+			// zero keys are left to the database
+			if !isZero(f) {
+				u.insert[fi.Key] = f.Interface()
+			}
+		case fi.Version && !insertOnly:
+			u.version = fi.Key
+		case fi.Created || insertOnly:
+			u.insert[fi.Key] = f.Interface()
+		default:
+			u.set[fi.Key] = f.Interface()
+		}
+	}
+
+	inserted, returned, err := drv.upsert(col.Name(), u)
+	if err != nil {
+		return false, err
+	}
+	return inserted, s.setReturned(itemv, sinfo, returned)
+}
+
+// setReturned sets the primary key, created and version fields of the item
+// to the values returned by a native upsert.
+func (s *Session) setReturned(itemv reflect.Value, sinfo *structInfo, returned map[string]interface{}) error {
+	if fi := sinfo.PKFieldInfo; fi != nil {
+		if id, ok := returned[fi.Key]; ok {
+			err := s.setPrimaryKey(itemv, id)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	v := indirectStruct(itemv)
+	for _, fi := range sinfo.FieldsList {
+		val, ok := returned[fi.Key]
+		if !ok || val == nil || (fi.PK && sinfo.PKFieldInfo != nil) {
+			continue
+		}
+		f := v.FieldByIndex(fi.Index)
+		if t, ok := val.(time.Time); ok && fi.Created {
+			setTime(f, t, fi.UTC)
+			continue
+		}
+		x, err := convertID(val, f.Type())
+		if err != nil {
+			return err
+		}
+		f.Set(x)
+	}
+	return nil
+}
+
+// upsertFallback looks up the record matching cond, and updates it with
+// the item or inserts the item if there is none. The item keeps the primary
+// key, created and version fields of an existing record.
+func (s *Session) upsertFallback(col db.Collection, itemv reflect.Value, sinfo *structInfo, cond db.Cond) (bool, error) {
+	v := indirectStruct(itemv)
+	existing := reflect.New(v.Type())
+	err := col.Find(cond).One(existing.Interface())
+	if err == db.ErrNoMoreRows {
+		oid, err := col.Append(itemv.Interface())
+		if err != nil {
+			return false, err
+		}
+		return true, s.setPrimaryKey(itemv, oid)
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, fi := range sinfo.FieldsList {
+		if fi.PK || fi.Created || fi.Version {
+			v.FieldByIndex(fi.Index).Set(existing.Elem().FieldByIndex(fi.Index))
+		}
+	}
+	return false, s.update(col, itemv, cond)
+}
+
+// createFallback inserts the item unless a record matches cond.
+func (s *Session) createFallback(col db.Collection, itemv reflect.Value, cond db.Cond) (bool, error) {
+	n, err := col.Find(cond).Count()
+	if err != nil {
+		return false, err
+	}
+	if n > 0 {
+		return false, nil
+	}
+	oid, err := col.Append(itemv.Interface())
+	if err != nil {
+		return false, err
+	}
+	return true, s.setPrimaryKey(itemv, oid)
+}
+
+// upsertKeys returns the fields named by keyFields, or the primary key
+// fields when there are none.
+func upsertKeys(sinfo *structInfo, keyFields []string) ([]*fieldInfo, error) {
+	if len(keyFields) == 0 {
+		if len(sinfo.PKFieldsList) == 0 {
+			return nil, ErrNoPrimaryKey
+		}
+		return sinfo.PKFieldsList, nil
+	}
+	keys := make([]*fieldInfo, len(keyFields))
+	for i, name := range keyFields {
+		keys[i] = sinfo.field(name)
+		if keys[i] == nil {
+			return nil, &UnknownFieldError{Type: sinfo.Zero.Type(), Name: name}
+		}
+	}
+	return keys, nil
+}
+
+// keyCond returns the condition matching the values of the key fields of v.
+// Zero primary key fields are left nil.
+func keyCond(v reflect.Value, keys []*fieldInfo) db.Cond {
+	cond := make(db.Cond, len(keys))
+	for _, fi := range keys {
+		f := v.FieldByIndex(fi.Index)
+		if fi.PK && isZero(f) {
+			cond[fi.Key] = nil
+			continue
+		}
+		cond[fi.Key] = f.Interface()
+	}
+	return cond
+}
+
+// setFields sets the fields of v named by the keys of values, which may be
+// db keys or Go field names.
+func setFields(v reflect.Value, sinfo *structInfo, values map[string]interface{}) error {
+	for name, val := range values {
+		fi := sinfo.field(name)
+		if fi == nil {
+			return &UnknownFieldError{Type: sinfo.Zero.Type(), Name: name}
+		}
+		f := v.FieldByIndex(fi.Index)
+		if val == nil {
+			f.Set(fi.Zero)
+			continue
+		}
+		x, err := convertID(val, f.Type())
+		if err != nil {
+			return fmt.Errorf("bondb: cannot set %s.%s to %T", sinfo.Zero.Type(), fi.Name, val)
+		}
+		f.Set(x)
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package bondb
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// FieldError describes a single struct field that failed validation.
+type FieldError struct {
+	Name string // Go field name
+	Key  string // db field key
+	Rule string // the rule that failed, ie. "required"
+}
+
+func (e FieldError) Error() string {
+	return fmt.Sprintf("%s (%s) failed %s", e.Name, e.Key, e.Rule)
+}
+
+// ValidationError is returned by Create, Save and Update when one or more
+// fields of an item fail validation. Fields lists every offending field.
+type ValidationError struct {
+	Type   reflect.Type
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.Error()
+	}
+	return fmt.Sprintf("validation failed for %s: %s", e.Type, strings.Join(msgs, ", "))
+}
+
+// validate checks the fields of itemv against their bondb tag flags. Rules
+// other than required are skipped for empty fields that aren't required.
+// When names is non-empty, only the fields with those Go names are checked.
+func validate(itemv reflect.Value, names ...string) error {
+	v := indirectStruct(itemv)
+	if !v.IsValid() {
+		return nil
+	}
+	sinfo, err := getStructInfo(v.Type())
+	if err != nil {
+		return err
+	}
+
+	var errs []FieldError
+	for _, fi := range sinfo.FieldsList {
+		if len(names) > 0 && !containsString(names, fi.Name) {
+			continue
+		}
+		f := v.FieldByIndex(fi.Index)
+		if isZero(f) {
+			if fi.Required {
+				errs = append(errs, FieldError{Name: fi.Name, Key: fi.Key, Rule: "required"})
+			}
+			continue // rules don't apply to empty optional values
+		}
+		for f.Kind() == reflect.Ptr && !f.IsNil() {
+			f = f.Elem()
+		}
+		if f.Kind() == reflect.Ptr {
+			continue // rules don't apply to nil values
+		}
+		for _, r := range fi.Rules {
+			if !r.check(f) {
+				errs = append(errs, FieldError{Name: fi.Name, Key: fi.Key, Rule: r.name})
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return &ValidationError{Type: v.Type(), Fields: errs}
+	}
+	return nil
+}
+
+// rule is a validation rule compiled from a bondb tag, ie. "min=1".
+type rule struct {
+	name  string // the rule as written in the tag
+	check func(v reflect.Value) bool
+}
+
+var errUnknownRule = errors.New("unknown rule")
+
+var emailRegexp = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+
+// newRule compiles the rule name=arg for a field of type t. It returns
+// errUnknownRule if name isn't a validation rule.
+func newRule(name, arg string, t reflect.Type) (rule, error) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	r := rule{name: name}
+	if arg != "" {
+		r.name += "=" + arg
+	}
+
+	switch name {
+	case "min", "max":
+		n, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return r, err
+		}
+		size, err := sizeFunc(t)
+		if err != nil {
+			return r, err
+		}
+		if name == "min" {
+			r.check = func(v reflect.Value) bool { return size(v) >= n }
+		} else {
+			r.check = func(v reflect.Value) bool { return size(v) <= n }
+		}
+
+	case "len":
+		n, err := strconv.Atoi(arg)
+		if err != nil {
+			return r, err
+		}
+		switch t.Kind() {
+		case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		default:
+			return r, fmt.Errorf("len is not supported for %s", t)
+		}
+		r.check = func(v reflect.Value) bool {
+			if v.Kind() == reflect.String {
+				return len([]rune(v.String())) == n
+			}
+			return v.Len() == n
+		}
+
+	case "oneof":
+		values := strings.Split(arg, "|")
+		switch t.Kind() {
+		case reflect.Slice, reflect.Map, reflect.Array, reflect.Struct:
+			return r, fmt.Errorf("oneof is not supported for %s", t)
+		}
+		r.check = func(v reflect.Value) bool {
+			return containsString(values, fmt.Sprint(v.Interface()))
+		}
+
+	case "match":
+		re, err := regexp.Compile(arg)
+		if err != nil {
+			return r, err
+		}
+		if t.Kind() != reflect.String {
+			return r, fmt.Errorf("match is not supported for %s", t)
+		}
+		r.check = func(v reflect.Value) bool { return re.MatchString(v.String()) }
+
+	case "email":
+		if t.Kind() != reflect.String {
+			return r, fmt.Errorf("email is not supported for %s", t)
+		}
+		r.check = func(v reflect.Value) bool { return emailRegexp.MatchString(v.String()) }
+
+	default:
+		return r, errUnknownRule
+	}
+	return r, nil
+}
+
+// sizeFunc returns a func that measures values of type t for the min and
+// max rules: numbers by their value, and strings, slices and maps by length.
+func sizeFunc(t reflect.Type) (func(v reflect.Value) float64, error) {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return func(v reflect.Value) float64 { return float64(v.Int()) }, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return func(v reflect.Value) float64 { return float64(v.Uint()) }, nil
+	case reflect.Float32, reflect.Float64:
+		return func(v reflect.Value) float64 { return v.Float() }, nil
+	case reflect.String:
+		return func(v reflect.Value) float64 { return float64(len([]rune(v.String()))) }, nil
+	case reflect.Slice, reflect.Map, reflect.Array:
+		return func(v reflect.Value) float64 { return float64(v.Len()) }, nil
+	}
+	return nil, fmt.Errorf("min and max are not supported for %s", t)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}